@@ -0,0 +1,156 @@
+package acme_test
+
+import (
+	"arla/acme"
+	"arla/acme/acmetest"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// setup starts a stub CA and a challenge server for a new Manager
+func setup(t *testing.T) (*acmetest.Server, *acme.Manager, func()) {
+	ca, err := acmetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "arlaacme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newManager(ca, dir)
+	challenges := httptest.NewServer(m.HTTPHandler(http.NotFoundHandler()))
+	ca.ChallengeAddr = strings.TrimPrefix(challenges.URL, "http://")
+	return ca, m, func() {
+		challenges.Close()
+		ca.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newManager(ca *acmetest.Server, dir string) *acme.Manager {
+	return &acme.Manager{
+		DirectoryURL: ca.DirectoryURL(),
+		Email:        "admin@example.test",
+		Domains:      []string{"example.test", "www.example.test"},
+		CacheDir:     dir,
+		RenewBefore:  30 * 24 * time.Hour,
+		PollInterval: 10 * time.Millisecond,
+	}
+}
+
+func TestObtain(t *testing.T) {
+	ca, m, cleanup := setup(t)
+	defer cleanup()
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Fatal("expected no certificate before one is issued")
+	}
+	if !m.NeedsRenewal() {
+		t.Fatal("expected missing certificate to need renewal")
+	}
+	if err := m.Obtain(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range m.Domains {
+		_, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: ca.Roots()})
+		if err != nil {
+			t.Fatalf("expected certificate to be valid for %s: %v", name, err)
+		}
+	}
+	if m.NeedsRenewal() {
+		t.Fatal("expected fresh certificate to not need renewal")
+	}
+	// a new manager should pick the certificate up from the cache
+	cached := newManager(ca, m.CacheDir)
+	if err := cached.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cached.NeedsRenewal() {
+		t.Fatal("expected cached certificate to not need renewal")
+	}
+	if ca.Issued() != 1 {
+		t.Fatalf("expected 1 certificate to be issued got %d", ca.Issued())
+	}
+	// certificates close to expiry should be renewed
+	cached.RenewBefore = 100 * 24 * time.Hour
+	if !cached.NeedsRenewal() {
+		t.Fatal("expected certificate within RenewBefore of expiry to need renewal")
+	}
+}
+
+func TestFailedChallenge(t *testing.T) {
+	ca, m, cleanup := setup(t)
+	defer cleanup()
+	// point the CA somewhere that doesn't answer challenges
+	wrong := httptest.NewServer(http.NotFoundHandler())
+	defer wrong.Close()
+	ca.ChallengeAddr = strings.TrimPrefix(wrong.URL, "http://")
+	err := m.Obtain()
+	if err == nil {
+		t.Fatal("expected obtain to fail when challenges are not answered")
+	}
+	if !strings.Contains(err.Error(), "unauthorized") {
+		t.Fatalf("expected unauthorized problem got %v", err)
+	}
+	if ca.Issued() != 0 {
+		t.Fatal("expected no certificates to be issued")
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	ca, m, cleanup := setup(t)
+	defer cleanup()
+	if err := m.Obtain(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}),
+		TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
+	}
+	if err := http2.ConfigureServer(srv, nil); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(tls.NewListener(l, srv.TLSConfig))
+	defer srv.Close()
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.Roots(), ServerName: "example.test"},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	res, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	if string(b) != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2.0 got %s", b)
+	}
+}
@@ -0,0 +1,427 @@
+// Package acmetest provides a minimal in-process ACME server for testing.
+// It validates http-01 challenges for real by fetching the key
+// authorization from ChallengeAddr and issues certificates signed by a
+// throwaway CA.
+package acmetest
+
+import (
+	"arla/acme"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a stub ACME certificate authority
+type Server struct {
+	// URL is the base URL of the server
+	URL string
+	// ChallengeAddr is the host:port that http-01 challenges are fetched
+	// from. If empty the identifier itself is used on port 80.
+	ChallengeAddr string
+	// Validity is the lifetime of issued certificates
+	Validity time.Duration
+
+	ts       *httptest.Server
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	mu       sync.Mutex
+	seq      int
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey
+	byKey    map[string]string
+	orders   map[string]*order
+	authzs   map[string]*authorization
+	certs    map[string][]byte
+	issued   int
+}
+
+type order struct {
+	acme.Order
+	account string
+}
+
+type authorization struct {
+	acme.Authorization
+	account string
+	order   string
+}
+
+// NewServer starts a stub ACME server. Call Close when finished.
+func NewServer() (*Server, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acmetest root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Validity: 90 * 24 * time.Hour,
+		caKey:    key,
+		caCert:   ca,
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*ecdsa.PublicKey),
+		byKey:    make(map[string]string),
+		orders:   make(map[string]*order),
+		authzs:   make(map[string]*authorization),
+		certs:    make(map[string][]byte),
+	}
+	s.ts = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.ts.URL
+	return s, nil
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.ts.Close()
+}
+
+// DirectoryURL is the URL to configure clients with
+func (s *Server) DirectoryURL() string {
+	return s.URL + "/directory"
+}
+
+// Roots returns a pool containing the CA certificate
+func (s *Server) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.caCert)
+	return pool
+}
+
+// Issued returns the number of certificates issued so far
+func (s *Server) Issued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued
+}
+
+// id returns a new unique object id. Must be called with mu held.
+func (s *Server) id() string {
+	s.seq++
+	return fmt.Sprint(s.seq)
+}
+
+// newNonce returns a fresh nonce. Must be called with mu held.
+func (s *Server) newNonce() string {
+	nonce := "nonce" + s.id()
+	s.nonces[nonce] = true
+	return nonce
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	path := r.URL.Path
+	switch {
+	case path == "/directory":
+		s.write(w, http.StatusOK, &acme.Directory{
+			NewNonce:   s.URL + "/nonce",
+			NewAccount: s.URL + "/account",
+			NewOrder:   s.URL + "/order",
+		})
+		return
+	case path == "/nonce":
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "POST" {
+		s.problem(w, http.StatusMethodNotAllowed, "malformed", "expected POST")
+		return
+	}
+	jws, account, ok := s.verify(w, r)
+	if !ok {
+		return
+	}
+	switch {
+	case path == "/account":
+		kid := s.byKey[account]
+		status := http.StatusOK
+		if kid == "" {
+			hdr, _ := jws.Header()
+			pub, _ := hdr.JWK.PublicKey()
+			kid = s.URL + "/account/" + s.id()
+			s.accounts[kid] = pub
+			s.byKey[account] = kid
+			status = http.StatusCreated
+		}
+		w.Header().Set("Location", kid)
+		s.write(w, status, map[string]string{"status": acme.StatusValid})
+	case path == "/order":
+		s.newOrder(w, jws, account)
+	case strings.HasPrefix(path, "/order/") && strings.HasSuffix(path, "/finalize"):
+		s.finalize(w, jws, account, strings.TrimSuffix(strings.TrimPrefix(path, "/order/"), "/finalize"))
+	case strings.HasPrefix(path, "/order/"):
+		o, ok := s.orders[strings.TrimPrefix(path, "/order/")]
+		if !ok || o.account != account {
+			s.problem(w, http.StatusNotFound, "malformed", "no such order")
+			return
+		}
+		s.write(w, http.StatusOK, &o.Order)
+	case strings.HasPrefix(path, "/authz/"):
+		a, ok := s.authzs[strings.TrimPrefix(path, "/authz/")]
+		if !ok || a.account != account {
+			s.problem(w, http.StatusNotFound, "malformed", "no such authorization")
+			return
+		}
+		s.write(w, http.StatusOK, &a.Authorization)
+	case strings.HasPrefix(path, "/challenge/"):
+		s.validate(w, account, strings.TrimPrefix(path, "/challenge/"))
+	case strings.HasPrefix(path, "/cert/"):
+		cert, ok := s.certs[strings.TrimPrefix(path, "/cert/")]
+		if !ok {
+			s.problem(w, http.StatusNotFound, "malformed", "no such certificate")
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(cert)
+	default:
+		s.problem(w, http.StatusNotFound, "malformed", "not found")
+	}
+}
+
+// verify checks the request's nonce, url and signature. It returns the JWS
+// and the account it was signed by. New accounts are identified by the
+// thumbprint of their key and existing accounts by their key ID.
+func (s *Server) verify(w http.ResponseWriter, r *http.Request) (*acme.JWS, string, bool) {
+	jws := &acme.JWS{}
+	if err := json.NewDecoder(r.Body).Decode(jws); err != nil {
+		s.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, "", false
+	}
+	hdr, err := jws.Header()
+	if err != nil {
+		s.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, "", false
+	}
+	if !s.nonces[hdr.Nonce] {
+		s.problem(w, http.StatusBadRequest, "badNonce", "unknown nonce")
+		return nil, "", false
+	}
+	delete(s.nonces, hdr.Nonce)
+	if hdr.URL != s.URL+r.URL.Path {
+		s.problem(w, http.StatusUnauthorized, "unauthorized", "url mismatch")
+		return nil, "", false
+	}
+	var pub *ecdsa.PublicKey
+	var account string
+	switch {
+	case hdr.JWK != nil && r.URL.Path == "/account":
+		if pub, err = hdr.JWK.PublicKey(); err != nil {
+			s.problem(w, http.StatusBadRequest, "badPublicKey", err.Error())
+			return nil, "", false
+		}
+		account = hdr.JWK.Thumbprint()
+	case hdr.KID != "":
+		if pub = s.accounts[hdr.KID]; pub == nil {
+			s.problem(w, http.StatusBadRequest, "accountDoesNotExist", "unknown account")
+			return nil, "", false
+		}
+		account = acme.NewJWK(pub).Thumbprint()
+	default:
+		s.problem(w, http.StatusBadRequest, "malformed", "expected jwk or kid")
+		return nil, "", false
+	}
+	if err := jws.Verify(pub); err != nil {
+		s.problem(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return nil, "", false
+	}
+	return jws, account, true
+}
+
+func (s *Server) newOrder(w http.ResponseWriter, jws *acme.JWS, account string) {
+	var req struct {
+		Identifiers []acme.Identifier `json:"identifiers"`
+	}
+	if err := jws.DecodePayload(&req); err != nil || len(req.Identifiers) == 0 {
+		s.problem(w, http.StatusBadRequest, "malformed", "expected identifiers")
+		return
+	}
+	id := s.id()
+	o := &order{account: account}
+	o.Status = acme.StatusPending
+	o.Identifiers = req.Identifiers
+	o.Finalize = s.URL + "/order/" + id + "/finalize"
+	for _, ident := range req.Identifiers {
+		aid := s.id()
+		a := &authorization{account: account, order: id}
+		a.Status = acme.StatusPending
+		a.Identifier = ident
+		a.Challenges = []*acme.Challenge{{
+			Type:   "http-01",
+			URL:    s.URL + "/challenge/" + aid,
+			Token:  "token" + aid,
+			Status: acme.StatusPending,
+		}}
+		s.authzs[aid] = a
+		o.Authorizations = append(o.Authorizations, s.URL+"/authz/"+aid)
+	}
+	s.orders[id] = o
+	w.Header().Set("Location", s.URL+"/order/"+id)
+	s.write(w, http.StatusCreated, &o.Order)
+}
+
+// validate fetches the key authorization for the challenge from the client
+func (s *Server) validate(w http.ResponseWriter, account, id string) {
+	a, ok := s.authzs[id]
+	if !ok || a.account != account {
+		s.problem(w, http.StatusNotFound, "malformed", "no such challenge")
+		return
+	}
+	ch := a.Challenges[0]
+	if ch.Status == acme.StatusPending {
+		addr := s.ChallengeAddr
+		if addr == "" {
+			addr = a.Identifier.Value
+		}
+		req, _ := http.NewRequest("GET", "http://"+addr+acme.ChallengePath+ch.Token, nil)
+		req.Host = a.Identifier.Value
+		var got string
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			got = string(b)
+		}
+		pub := s.accountKey(account)
+		if pub != nil && got == acme.KeyAuthorization(ch.Token, pub) {
+			ch.Status = acme.StatusValid
+			a.Status = acme.StatusValid
+		} else {
+			ch.Status = acme.StatusInvalid
+			ch.Error = &acme.Problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: fmt.Sprintf("bad key authorization %q", got)}
+			a.Status = acme.StatusInvalid
+		}
+		s.updateOrder(a.order)
+	}
+	s.write(w, http.StatusOK, ch)
+}
+
+// accountKey returns the public key of the account with the thumbprint
+func (s *Server) accountKey(account string) *ecdsa.PublicKey {
+	return s.accounts[s.byKey[account]]
+}
+
+// updateOrder moves the order on once all of its authorizations are done
+func (s *Server) updateOrder(id string) {
+	o := s.orders[id]
+	status := acme.StatusReady
+	for _, url := range o.Authorizations {
+		a := s.authzs[url[strings.LastIndex(url, "/")+1:]]
+		if a.Status == acme.StatusInvalid {
+			status = acme.StatusInvalid
+			break
+		}
+		if a.Status != acme.StatusValid {
+			status = acme.StatusPending
+		}
+	}
+	o.Status = status
+}
+
+func (s *Server) finalize(w http.ResponseWriter, jws *acme.JWS, account, id string) {
+	o, ok := s.orders[id]
+	if !ok || o.account != account {
+		s.problem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	if o.Status != acme.StatusReady {
+		s.problem(w, http.StatusForbidden, "orderNotReady", "order is "+o.Status)
+		return
+	}
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := jws.DecodePayload(&req); err != nil {
+		s.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		s.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		s.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	var want []string
+	for _, ident := range o.Identifiers {
+		want = append(want, ident.Value)
+	}
+	got := append([]string{}, csr.DNSNames...)
+	sort.Strings(want)
+	sort.Strings(got)
+	if strings.Join(want, ",") != strings.Join(got, ",") {
+		s.problem(w, http.StatusBadRequest, "badCSR", "csr names do not match order")
+		return
+	}
+	s.issued++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(s.issued + 1)),
+		Subject:      pkix.Name{CommonName: got[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(s.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		s.problem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	s.certs[id] = chain
+	o.Status = acme.StatusValid
+	o.Certificate = s.URL + "/cert/" + id
+	s.write(w, http.StatusOK, &o.Order)
+}
+
+func (s *Server) write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&acme.Problem{
+		Type:   "urn:ietf:params:acme:error:" + typ,
+		Detail: detail,
+		Status: status,
+	})
+}
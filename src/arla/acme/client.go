@@ -0,0 +1,409 @@
+// Package acme implements enough of the ACME protocol (RFC 8555) to obtain
+// and renew certificates using http-01 challenges, along with a Manager
+// that caches certificates on disk and serves them to a tls.Config.
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LetsEncrypt is the production Let's Encrypt directory URL
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// Status values of ACME objects
+const (
+	StatusPending    = "pending"
+	StatusReady      = "ready"
+	StatusProcessing = "processing"
+	StatusValid      = "valid"
+	StatusInvalid    = "invalid"
+)
+
+// ErrBadNonce is the problem type returned when a request used a stale nonce
+const ErrBadNonce = "urn:ietf:params:acme:error:badNonce"
+
+var curve = elliptic.P256()
+
+// Directory lists the endpoints of an ACME server
+type Directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// Identifier is a name that a certificate is requested for
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Order is a request for a certificate
+type Order struct {
+	URL            string       `json:"-"`
+	Status         string       `json:"status"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *Problem     `json:"error,omitempty"`
+}
+
+// Authorization is the proof of control of an identifier
+type Authorization struct {
+	Status     string       `json:"status"`
+	Identifier Identifier   `json:"identifier"`
+	Challenges []*Challenge `json:"challenges"`
+}
+
+// Challenge is a method of proving control of an identifier
+type Challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+// Problem is an ACME error document (RFC 7807)
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+// Client talks to a single ACME server on behalf of a single account
+type Client struct {
+	// DirectoryURL is the ACME server's directory endpoint
+	DirectoryURL string
+	// Key is the account key
+	Key *ecdsa.PrivateKey
+	// HTTPClient is used for all requests (defaults to http.DefaultClient)
+	HTTPClient *http.Client
+	// PollInterval is the time between checks of pending objects
+	PollInterval time.Duration
+	// PollTimeout is how long to wait for pending objects to complete
+	PollTimeout time.Duration
+
+	mu     sync.Mutex
+	dir    *Directory
+	kid    string
+	nonces []string
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Discover fetches the server's directory
+func (c *Client) Discover() (*Directory, error) {
+	c.mu.Lock()
+	dir := c.dir
+	c.mu.Unlock()
+	if dir != nil {
+		return dir, nil
+	}
+	res, err := c.httpClient().Get(c.DirectoryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	dir = &Directory{}
+	if err := json.NewDecoder(res.Body).Decode(dir); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.dir = dir
+	c.mu.Unlock()
+	return dir, nil
+}
+
+// nonce returns an unused nonce, fetching a new one if none are cached
+func (c *Client) nonce() (string, error) {
+	c.mu.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mu.Unlock()
+		return nonce, nil
+	}
+	c.mu.Unlock()
+	dir, err := c.Discover()
+	if err != nil {
+		return "", err
+	}
+	res, err := c.httpClient().Head(dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: server did not return a nonce")
+	}
+	return nonce, nil
+}
+
+// saveNonce keeps the nonce from a response for the next request
+func (c *Client) saveNonce(res *http.Response) {
+	if nonce := res.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mu.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.mu.Unlock()
+	}
+}
+
+// post sends a signed request to url. Once registered requests are signed
+// with the account's key ID, otherwise the full key is included. Requests
+// that fail due to a bad nonce are retried once.
+func (c *Client) post(url string, payload interface{}) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.nonce()
+		if err != nil {
+			return nil, err
+		}
+		header := &Protected{Nonce: nonce, URL: url}
+		c.mu.Lock()
+		if c.kid != "" {
+			header.KID = c.kid
+		} else {
+			header.JWK = NewJWK(&c.Key.PublicKey)
+		}
+		c.mu.Unlock()
+		jws, err := Sign(c.Key, header, payload)
+		if err != nil {
+			return nil, err
+		}
+		body, err := json.Marshal(jws)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.httpClient().Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		c.saveNonce(res)
+		if res.StatusCode < 400 {
+			return res, nil
+		}
+		err = responseError(res)
+		res.Body.Close()
+		if p, ok := err.(*Problem); ok && p.Type == ErrBadNonce && attempt == 0 {
+			continue
+		}
+		return nil, err
+	}
+}
+
+// postJSON sends a signed request and decodes the JSON response into v
+func (c *Client) postJSON(url string, payload, v interface{}) (*http.Response, error) {
+	res, err := c.post(url, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Register creates an account for the client's key or fetches the existing
+// one. Terms of service are always agreed to.
+func (c *Client) Register(email string) error {
+	dir, err := c.Discover()
+	if err != nil {
+		return err
+	}
+	req := struct {
+		Contact              []string `json:"contact,omitempty"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	}{
+		TermsOfServiceAgreed: true,
+	}
+	if email != "" {
+		req.Contact = []string{"mailto:" + email}
+	}
+	res, err := c.postJSON(dir.NewAccount, req, nil)
+	if err != nil {
+		return err
+	}
+	kid := res.Header.Get("Location")
+	if kid == "" {
+		return errors.New("acme: server did not return an account URL")
+	}
+	c.mu.Lock()
+	c.kid = kid
+	c.mu.Unlock()
+	return nil
+}
+
+// NewOrder requests a certificate for the domains
+func (c *Client) NewOrder(domains []string) (*Order, error) {
+	dir, err := c.Discover()
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		Identifiers []Identifier `json:"identifiers"`
+	}
+	for _, d := range domains {
+		req.Identifiers = append(req.Identifiers, Identifier{Type: "dns", Value: d})
+	}
+	order := &Order{}
+	res, err := c.postJSON(dir.NewOrder, req, order)
+	if err != nil {
+		return nil, err
+	}
+	order.URL = res.Header.Get("Location")
+	return order, nil
+}
+
+// GetOrder fetches the current state of an order
+func (c *Client) GetOrder(url string) (*Order, error) {
+	order := &Order{}
+	if _, err := c.postJSON(url, nil, order); err != nil {
+		return nil, err
+	}
+	order.URL = url
+	return order, nil
+}
+
+// GetAuthorization fetches an authorization
+func (c *Client) GetAuthorization(url string) (*Authorization, error) {
+	authz := &Authorization{}
+	if _, err := c.postJSON(url, nil, authz); err != nil {
+		return nil, err
+	}
+	return authz, nil
+}
+
+// Accept tells the server that a challenge is ready to be validated
+func (c *Client) Accept(ch *Challenge) error {
+	_, err := c.postJSON(ch.URL, struct{}{}, nil)
+	return err
+}
+
+// WaitAuthorization polls the authorization until it is no longer pending
+func (c *Client) WaitAuthorization(url string) (*Authorization, error) {
+	var authz *Authorization
+	err := c.poll(func() (bool, error) {
+		var err error
+		if authz, err = c.GetAuthorization(url); err != nil {
+			return false, err
+		}
+		switch authz.Status {
+		case StatusValid:
+			return true, nil
+		case StatusPending, StatusProcessing:
+			return false, nil
+		}
+		for _, ch := range authz.Challenges {
+			if ch.Error != nil {
+				return false, ch.Error
+			}
+		}
+		return false, fmt.Errorf("acme: authorization for %s is %s", authz.Identifier.Value, authz.Status)
+	})
+	return authz, err
+}
+
+// Finalize submits the DER encoded CSR and waits for the certificate to be
+// issued, returning its URL.
+func (c *Client) Finalize(order *Order, csr []byte) (string, error) {
+	req := struct {
+		CSR string `json:"csr"`
+	}{
+		CSR: encode(csr),
+	}
+	if _, err := c.postJSON(order.Finalize, req, nil); err != nil {
+		return "", err
+	}
+	err := c.poll(func() (bool, error) {
+		var err error
+		if order, err = c.GetOrder(order.URL); err != nil {
+			return false, err
+		}
+		switch order.Status {
+		case StatusValid:
+			return true, nil
+		case StatusPending, StatusReady, StatusProcessing:
+			return false, nil
+		}
+		if order.Error != nil {
+			return false, order.Error
+		}
+		return false, fmt.Errorf("acme: order is %s", order.Status)
+	})
+	if err != nil {
+		return "", err
+	}
+	return order.Certificate, nil
+}
+
+// Certificate downloads the PEM encoded certificate chain
+func (c *Client) Certificate(url string) ([]byte, error) {
+	res, err := c.post(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+// poll calls fn until it returns done or an error, or the timeout expires
+func (c *Client) poll(fn func() (bool, error)) error {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	timeout := c.PollTimeout
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := fn()
+		if err != nil || done {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.New("acme: timed out waiting for server")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// responseError converts an error response into a Problem
+func responseError(res *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	p := &Problem{}
+	if err := json.Unmarshal(b, p); err != nil || p.Type == "" {
+		return fmt.Errorf("acme: unexpected response %s: %s", res.Status, bytes.TrimSpace(b))
+	}
+	if p.Status == 0 {
+		p.Status = res.StatusCode
+	}
+	return p
+}
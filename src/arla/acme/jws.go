@@ -0,0 +1,155 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JWK is the JSON Web Key form of a P-256 public key
+type JWK struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWS is a flattened JSON Web Signature as used in ACME requests
+type JWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// Protected is the protected header of an ACME request
+type Protected struct {
+	Alg   string `json:"alg"`
+	Nonce string `json:"nonce"`
+	URL   string `json:"url"`
+	JWK   *JWK   `json:"jwk,omitempty"`
+	KID   string `json:"kid,omitempty"`
+}
+
+// encode is unpadded base64url as required by JWS
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// NewJWK returns the JWK for a P-256 public key
+func NewJWK(pub *ecdsa.PublicKey) *JWK {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	return &JWK{
+		Crv: "P-256",
+		Kty: "EC",
+		X:   encode(pub.X.FillBytes(x)),
+		Y:   encode(pub.Y.FillBytes(y)),
+	}
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key. The JWK fields
+// are already in the required lexicographic order.
+func (k *JWK) Thumbprint() string {
+	b, _ := json.Marshal(k)
+	sum := sha256.Sum256(b)
+	return encode(sum[:])
+}
+
+// PublicKey converts the JWK back to a public key
+func (k *JWK) PublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
+
+// KeyAuthorization is the response to a challenge token for the given key
+func KeyAuthorization(token string, pub *ecdsa.PublicKey) string {
+	return token + "." + NewJWK(pub).Thumbprint()
+}
+
+// Sign creates a JWS of payload using the ES256 algorithm. A nil payload
+// produces an empty payload as used by POST-as-GET requests.
+func Sign(key *ecdsa.PrivateKey, header *Protected, payload interface{}) (*JWS, error) {
+	header.Alg = "ES256"
+	h, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	var p []byte
+	if payload != nil {
+		if p, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	jws := &JWS{
+		Protected: encode(h),
+		Payload:   encode(p),
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	jws.Signature = encode(sig)
+	return jws, nil
+}
+
+// Verify checks the signature of the JWS and decodes its protected header
+func (jws *JWS) Verify(pub *ecdsa.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, digest[:], r, s) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// Header decodes the protected header without verifying the signature
+func (jws *JWS) Header() (*Protected, error) {
+	b, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+	var h Protected
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// DecodePayload unmarshals the payload into v. Empty payloads are ignored.
+func (jws *JWS) DecodePayload(v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,330 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChallengePath is the path prefix that http-01 challenges are served from
+const ChallengePath = "/.well-known/acme-challenge/"
+
+// Manager obtains a single certificate covering Domains and renews it before
+// it expires. The account key and certificate are cached in CacheDir.
+type Manager struct {
+	// DirectoryURL is the ACME server's directory (defaults to LetsEncrypt)
+	DirectoryURL string
+	// Email is the contact address for the account
+	Email string
+	// Domains are the names the certificate is issued for
+	Domains []string
+	// CacheDir is where the account key and certificate are stored
+	CacheDir string
+	// RenewBefore is how long before expiry the certificate is renewed
+	RenewBefore time.Duration
+	// HTTPClient is used to talk to the ACME server
+	HTTPClient *http.Client
+	// PollInterval is passed on to the Client
+	PollInterval time.Duration
+
+	mu     sync.RWMutex
+	client *Client
+	cert   *tls.Certificate
+	tokens map[string]string
+}
+
+// accountKeyFile is the path of the cached account key
+func (m *Manager) accountKeyFile() string {
+	return filepath.Join(m.CacheDir, "account.key")
+}
+
+// certFile is the path of the cached certificate chain and key
+func (m *Manager) certFile() string {
+	return filepath.Join(m.CacheDir, m.Domains[0]+".pem")
+}
+
+// Load reads a previously obtained certificate from the cache. It is not an
+// error for the cache to be empty.
+func (m *Manager) Load() error {
+	if len(m.Domains) == 0 {
+		return errors.New("acme: no domains configured")
+	}
+	b, err := ioutil.ReadFile(m.certFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return fmt.Errorf("acme: invalid cached certificate %s: %v", m.certFile(), err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	return nil
+}
+
+// NeedsRenewal returns true if there is no certificate, it does not cover
+// all of the Domains, or it expires within RenewBefore.
+func (m *Manager) NeedsRenewal() bool {
+	m.mu.RLock()
+	cert := m.cert
+	m.mu.RUnlock()
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	for _, d := range m.Domains {
+		if cert.Leaf.VerifyHostname(d) != nil {
+			return true
+		}
+	}
+	return time.Now().Add(m.RenewBefore).After(cert.Leaf.NotAfter)
+}
+
+// GetCertificate implements the tls.Config callback
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("acme: certificate has not been issued yet")
+	}
+	return m.cert, nil
+}
+
+// HTTPHandler responds to http-01 challenges and passes all other requests
+// on to fallback.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, ChallengePath) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		m.mu.RLock()
+		keyAuth, ok := m.tokens[strings.TrimPrefix(r.URL.Path, ChallengePath)]
+		m.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// Run keeps the certificate renewed until stop is closed. Failed attempts
+// are passed to onError and retried after a minute.
+func (m *Manager) Run(stop <-chan struct{}, onError func(error)) {
+	for {
+		wait := 12 * time.Hour
+		if m.NeedsRenewal() {
+			if err := m.Obtain(); err != nil {
+				if onError != nil {
+					onError(err)
+				}
+				wait = time.Minute
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Obtain issues a new certificate and writes it to the cache
+func (m *Manager) Obtain() error {
+	if len(m.Domains) == 0 {
+		return errors.New("acme: no domains configured")
+	}
+	client, err := m.registeredClient()
+	if err != nil {
+		return err
+	}
+	order, err := client.NewOrder(m.Domains)
+	if err != nil {
+		return err
+	}
+	for _, url := range order.Authorizations {
+		if err := m.authorize(client, url); err != nil {
+			return err
+		}
+	}
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.Domains[0]},
+		DNSNames: m.Domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	certURL, err := client.Finalize(order, csr)
+	if err != nil {
+		return err
+	}
+	chain, err := client.Certificate(certURL)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return fmt.Errorf("acme: issued certificate is invalid: %v", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(m.certFile(), append(append([]byte{}, chain...), keyPEM...)); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	return nil
+}
+
+// authorize completes the http-01 challenge for a pending authorization
+func (m *Manager) authorize(client *Client, url string) error {
+	authz, err := client.GetAuthorization(url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == StatusValid {
+		return nil
+	}
+	var challenge *Challenge
+	for _, ch := range authz.Challenges {
+		if ch.Type == "http-01" {
+			challenge = ch
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("acme: no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	m.mu.Lock()
+	if m.tokens == nil {
+		m.tokens = make(map[string]string)
+	}
+	m.tokens[challenge.Token] = KeyAuthorization(challenge.Token, &client.Key.PublicKey)
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.tokens, challenge.Token)
+		m.mu.Unlock()
+	}()
+	if err := client.Accept(challenge); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(url)
+	return err
+}
+
+// registeredClient returns a client for the cached account key, creating
+// the key and registering the account as required.
+func (m *Manager) registeredClient() (*Client, error) {
+	m.mu.RLock()
+	client := m.client
+	m.mu.RUnlock()
+	if client != nil {
+		return client, nil
+	}
+	if err := os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client = &Client{
+		DirectoryURL: m.DirectoryURL,
+		Key:          key,
+		HTTPClient:   m.HTTPClient,
+		PollInterval: m.PollInterval,
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = LetsEncrypt
+	}
+	if err := client.Register(m.Email); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.client = client
+	m.mu.Unlock()
+	return client, nil
+}
+
+// accountKey loads the account key from the cache or generates a new one
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(m.accountKeyFile())
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("acme: invalid account key %s", m.accountKeyFile())
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(m.accountKeyFile(), keyPEM); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encodeKey PEM encodes an EC private key
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFile atomically replaces the file at path with b
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
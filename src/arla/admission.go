@@ -0,0 +1,36 @@
+package main
+
+import (
+	"arla/admission"
+	"net/http"
+)
+
+// endpointPriorities orders requests waiting for a database connection.
+// Logins and dry runs of mutations (the only /exec requests that wait for a
+// query connection) are favoured over queries and batches of queries which
+// tend to be heavier and are easier for clients to retry.
+var endpointPriorities = map[string]admission.Priority{
+	"/exec":              admission.High,
+	"/authenticate":      admission.High,
+	"/authenticate/totp": admission.High,
+	"/register":          admission.Normal,
+	"/query":             admission.Low,
+	"/batch":             admission.Low,
+}
+
+// admit waits for a connection slot in the pool guarded by g. The returned
+// func must be called once the connection is no longer needed.
+func (s *Server) admit(g *admission.Gate, r *http.Request) (func(), *Error) {
+	p, ok := endpointPriorities[r.URL.Path]
+	if !ok {
+		p = admission.Normal
+	}
+	release, err := g.Acquire(r.Context(), p)
+	if err == admission.ErrOverloaded {
+		return nil, overloadedError(err, g.RetryAfter())
+	} else if err != nil {
+		// the client has gone away
+		return nil, userError(err)
+	}
+	return release, nil
+}
@@ -0,0 +1,254 @@
+// Package admission limits the number of requests using a resource at once
+// (such as a pool of database connections). Requests that cannot be served
+// immediately wait in a bounded queue ordered by priority. Requests that
+// would wait too long are rejected straight away so that clients can back
+// off rather than piling up behind a saturated pool.
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Priority orders waiting requests. Higher priorities are admitted first.
+type Priority int
+
+// Priorities
+const (
+	Low Priority = iota
+	Normal
+	High
+)
+
+// ErrOverloaded is returned when a request is not admitted
+var ErrOverloaded = errors.New("admission: too many requests waiting")
+
+// Stats are counters describing the gate's load
+type Stats struct {
+	Slots    int   `json:"slots"`
+	Active   int   `json:"active"`
+	Queued   int   `json:"queued"`
+	Admitted int64 `json:"admitted"`
+	Rejected int64 `json:"rejected"`
+	Shed     int64 `json:"shed"`
+	// Cancelled counts waiting requests whose context was done
+	Cancelled int64 `json:"cancelled"`
+	// AvgHold is the moving average time in milliseconds a slot is held for
+	AvgHold float64 `json:"avgHoldMs"`
+}
+
+type waiter struct {
+	priority Priority
+	ready    chan struct{}
+	err      error
+}
+
+// Gate admits up to Slots requests at once
+type Gate struct {
+	slots    int
+	maxQueue int
+	maxWait  time.Duration
+	// Now returns the current time (replaceable for tests)
+	Now func() time.Time
+
+	mu     sync.Mutex
+	active int
+	queue  []*waiter
+	// avgHold is an exponentially weighted moving average of hold times
+	avgHold time.Duration
+	stats   Stats
+}
+
+// New creates a Gate with the given number of slots. At most maxQueue
+// requests wait for a slot and none waits longer than maxWait. A gate with
+// zero or fewer slots is nil, which admits everything.
+func New(slots, maxQueue int, maxWait time.Duration) *Gate {
+	if slots <= 0 {
+		return nil
+	}
+	return &Gate{
+		slots:    slots,
+		maxQueue: maxQueue,
+		maxWait:  maxWait,
+		Now:      time.Now,
+	}
+}
+
+// Acquire waits for a slot. The returned func must be called to release the
+// slot once the resource is no longer in use. If the request cannot be
+// admitted in time ErrOverloaded is returned. If ctx is done while waiting
+// the request leaves the queue and ctx's error is returned.
+func (g *Gate) Acquire(ctx context.Context, p Priority) (release func(), err error) {
+	if g == nil {
+		return func() {}, nil
+	}
+	g.mu.Lock()
+	if g.active < g.slots && len(g.queue) == 0 {
+		g.active++
+		g.stats.Admitted++
+		g.mu.Unlock()
+		return g.releaser(), nil
+	}
+	if g.estimate(p) > g.maxWait || !g.makeRoom(p) {
+		g.stats.Rejected++
+		g.mu.Unlock()
+		return nil, ErrOverloaded
+	}
+	w := &waiter{priority: p, ready: make(chan struct{})}
+	g.enqueue(w)
+	g.mu.Unlock()
+
+	timer := time.NewTimer(g.maxWait)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+		g.mu.Lock()
+		if g.dequeue(w) {
+			g.stats.Rejected++
+			g.mu.Unlock()
+			return nil, ErrOverloaded
+		}
+		// admitted or shed while the timer fired
+		g.mu.Unlock()
+		<-w.ready
+	case <-ctx.Done():
+		g.mu.Lock()
+		if g.dequeue(w) {
+			g.stats.Cancelled++
+			g.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		// admitted or shed while ctx was done
+		g.mu.Unlock()
+		<-w.ready
+		if w.err == nil {
+			g.releaser()()
+		}
+		return nil, ctx.Err()
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return g.releaser(), nil
+}
+
+// releaser returns a func that hands the slot to the next waiter. It is
+// safe to call more than once.
+func (g *Gate) releaser() func() {
+	start := g.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.record(g.Now().Sub(start))
+			if len(g.queue) == 0 {
+				g.active--
+				return
+			}
+			w := g.queue[0]
+			g.queue = g.queue[1:]
+			g.stats.Admitted++
+			close(w.ready)
+		})
+	}
+}
+
+// record updates the moving average hold time. Must be called with mu held.
+func (g *Gate) record(d time.Duration) {
+	if g.avgHold == 0 {
+		g.avgHold = d
+		return
+	}
+	g.avgHold = (g.avgHold*7 + d) / 8
+}
+
+// estimate returns how long a request with priority p is likely to wait.
+// Must be called with mu held.
+func (g *Gate) estimate(p Priority) time.Duration {
+	ahead := 1
+	for _, w := range g.queue {
+		if w.priority >= p {
+			ahead++
+		}
+	}
+	return g.avgHold * time.Duration(ahead) / time.Duration(g.slots)
+}
+
+// makeRoom returns true if there is space in the queue for a request with
+// priority p, shedding the newest lowest priority waiter if the queue is
+// full and it has a lower priority. Must be called with mu held.
+func (g *Gate) makeRoom(p Priority) bool {
+	if len(g.queue) < g.maxQueue {
+		return true
+	}
+	if len(g.queue) == 0 {
+		return false
+	}
+	last := g.queue[len(g.queue)-1]
+	if last.priority >= p {
+		return false
+	}
+	g.queue = g.queue[:len(g.queue)-1]
+	g.stats.Shed++
+	last.err = ErrOverloaded
+	close(last.ready)
+	return true
+}
+
+// enqueue inserts w after all waiters of the same or higher priority. Must
+// be called with mu held.
+func (g *Gate) enqueue(w *waiter) {
+	i := len(g.queue)
+	for i > 0 && g.queue[i-1].priority < w.priority {
+		i--
+	}
+	g.queue = append(g.queue, nil)
+	copy(g.queue[i+1:], g.queue[i:])
+	g.queue[i] = w
+}
+
+// dequeue removes w from the queue returning false if it was not waiting.
+// Must be called with mu held.
+func (g *Gate) dequeue(w *waiter) bool {
+	for i, q := range g.queue {
+		if q == w {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RetryAfter suggests how long a rejected client should wait before trying
+// again
+func (g *Gate) RetryAfter() time.Duration {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	d := g.estimate(Low)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// Stats returns a snapshot of the gate's counters
+func (g *Gate) Stats() Stats {
+	if g == nil {
+		return Stats{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.stats
+	s.Slots = g.slots
+	s.Active = g.active
+	s.Queued = len(g.queue)
+	s.AvgHold = float64(g.avgHold) / float64(time.Millisecond)
+	return s
+}
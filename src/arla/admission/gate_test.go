@@ -0,0 +1,163 @@
+package admission
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+// waitQueued blocks until n requests are waiting
+func waitQueued(t *testing.T, g *Gate, n int) {
+	for i := 0; i < 100; i++ {
+		if g.Stats().Queued == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d queued requests got %d", n, g.Stats().Queued)
+}
+
+func TestAcquire(t *testing.T) {
+	g := New(1, 10, time.Second)
+	release, err := g.Acquire(ctx, Normal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		r, err := g.Acquire(ctx, Normal)
+		if err == nil {
+			r()
+		}
+		done <- err
+	}()
+	waitQueued(t, g, 1)
+	release()
+	release() // releasing twice must not free another slot
+	if err := <-done; err != nil {
+		t.Fatalf("expected waiting request to be admitted got %v", err)
+	}
+	if s := g.Stats(); s.Active != 0 || s.Admitted != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	g := New(1, 10, time.Second)
+	release, _ := g.Acquire(ctx, Normal)
+	order := make(chan Priority, 2)
+	acquire := func(p Priority) {
+		r, err := g.Acquire(ctx, p)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		order <- p
+		r()
+	}
+	go acquire(Low)
+	waitQueued(t, g, 1)
+	go acquire(High)
+	waitQueued(t, g, 2)
+	release()
+	if p := <-order; p != High {
+		t.Fatalf("expected high priority request to be admitted first got %v", p)
+	}
+	<-order
+}
+
+func TestQueueFull(t *testing.T) {
+	g := New(1, 1, time.Second)
+	release, _ := g.Acquire(ctx, Normal)
+	defer release()
+	shed := make(chan error)
+	go func() {
+		_, err := g.Acquire(ctx, Low)
+		shed <- err
+	}()
+	waitQueued(t, g, 1)
+	if _, err := g.Acquire(ctx, Low); err != ErrOverloaded {
+		t.Fatalf("expected full queue to reject got %v", err)
+	}
+	// a higher priority request takes the place of a lower one
+	admitted := make(chan error)
+	go func() {
+		r, err := g.Acquire(ctx, High)
+		if err == nil {
+			r()
+		}
+		admitted <- err
+	}()
+	if err := <-shed; err != ErrOverloaded {
+		t.Fatalf("expected low priority request to be shed got %v", err)
+	}
+	release()
+	if err := <-admitted; err != nil {
+		t.Fatal(err)
+	}
+	if s := g.Stats(); s.Rejected != 1 || s.Shed != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	g := New(1, 10, 20*time.Millisecond)
+	release, _ := g.Acquire(ctx, Normal)
+	defer release()
+	if _, err := g.Acquire(ctx, Normal); err != ErrOverloaded {
+		t.Fatalf("expected request to time out got %v", err)
+	}
+	if g.Stats().Queued != 0 {
+		t.Fatal("expected timed out request to leave the queue")
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	now := time.Now()
+	g := New(1, 10, time.Second)
+	g.Now = func() time.Time { return now }
+	release, _ := g.Acquire(ctx, Normal)
+	now = now.Add(5 * time.Second)
+	release()
+	// the slot is busy and requests take longer than maxWait
+	release, _ = g.Acquire(ctx, Normal)
+	defer release()
+	start := time.Now()
+	if _, err := g.Acquire(ctx, Normal); err != ErrOverloaded {
+		t.Fatalf("expected slow pool to reject got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("expected rejection to be immediate")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	var g *Gate = New(0, 0, 0)
+	release, err := g.Acquire(ctx, Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestCancel(t *testing.T) {
+	g := New(1, 10, time.Second)
+	release, _ := g.Acquire(ctx, Normal)
+	defer release()
+	cctx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		_, err := g.Acquire(cctx, Normal)
+		done <- err
+	}()
+	waitQueued(t, g, 1)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected cancelled request to give up got %v", err)
+	}
+	if s := g.Stats(); s.Queued != 0 || s.Cancelled != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
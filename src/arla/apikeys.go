@@ -0,0 +1,188 @@
+package main
+
+import (
+	"arla/schema"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIKeyHeader is the request header used to pass an api key.
+// Keys may also be sent as "Authorization: ApiKey <key>"
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyPrefix is prepended to all generated keys to make them easy to spot
+const apiKeyPrefix = "ak_"
+
+// hashAPIKey returns the hex encoded sha256 of key. Keys are 256bits of
+// random data so a fast hash is sufficient here.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey generates a random api key
+func newAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// apiKeyFromRequest extracts an api key from the request headers if present
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "apikey ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// remoteIP returns the IP address of the client without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestAPIKey returns the api key that was used to authenticate r (if any)
+func requestAPIKey(r *http.Request) *schema.APIKey {
+	k, _ := r.Context().Value(apiKeyContextKey).(*schema.APIKey)
+	return k
+}
+
+// authenticateAPIKey looks up the key and checks that it may be used from
+// the client's address. On success the returned request carries the key.
+func (s *Server) authenticateAPIKey(r *http.Request, key string) (*http.Request, schema.Token, *Error) {
+	if s.qs == nil {
+		return nil, nil, tempError()
+	}
+	release, e := s.admit(s.queryGate, r)
+	if e != nil {
+		return nil, nil, e
+	}
+	k, err := s.qs.APIKey(hashAPIKey(key))
+	release()
+	if err != nil {
+		return nil, nil, internalError(err)
+	}
+	if k == nil {
+		return nil, nil, authError(fmt.Errorf("invalid api key"))
+	}
+	if ip := remoteIP(r); !k.AllowsIP(ip) {
+		return nil, nil, authError(fmt.Errorf("api key %s not allowed from %s", k.ID, ip))
+	}
+	r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, k))
+	return r, k.Claims, nil
+}
+
+// createAPIKeyHandler generates a new api key with the claims, actions and ips
+// given in the request body. The key is returned exactly once - only a hash of
+// it is stored (via the mutation log so that it survives replay).
+func (s *Server) createAPIKeyHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	var req struct {
+		Name    string       `json:"name"`
+		Claims  schema.Token `json:"claims"`
+		Actions []string     `json:"actions"`
+		IPs     []string     `json:"ips"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return userError(err)
+	}
+	if len(req.Claims) == 0 {
+		return userError(errors.New("api key claims cannot be empty"))
+	}
+	for _, ip := range req.IPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			return userError(fmt.Errorf("invalid ip or cidr: %s", ip))
+		}
+	}
+	key, err := newAPIKey()
+	if err != nil {
+		return internalError(err)
+	}
+	id := schema.TimeUUID()
+	m := &schema.Mutation{
+		ID:    schema.TimeUUID(),
+		Token: t,
+		Name:  schema.CreateAPIKeyMutation,
+		Args:  []interface{}{id, hashAPIKey(key), req.Name, req.Claims, req.Actions, req.IPs, time.Now().Unix()},
+	}
+	if err := s.commit(r.Context(), m); err != nil {
+		return err
+	}
+	err = json.NewEncoder(w).Encode(&struct {
+		ID  schema.UUID `json:"id"`
+		Key string      `json:"key"`
+	}{
+		ID:  id,
+		Key: key,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// revokeAPIKeyHandler permanently disables the api key with the given id
+func (s *Server) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	var req struct {
+		ID schema.UUID `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return userError(err)
+	}
+	m := &schema.Mutation{
+		ID:    schema.TimeUUID(),
+		Token: t,
+		Name:  schema.RevokeAPIKeyMutation,
+		Args:  []interface{}{req.ID, time.Now().Unix()},
+	}
+	if err := s.commit(r.Context(), m); err != nil {
+		return err
+	}
+	err := json.NewEncoder(w).Encode(&struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// listAPIKeysHandler returns details of all api keys (but never the keys)
+func (s *Server) listAPIKeysHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	if s.qs == nil {
+		return tempError()
+	}
+	release, e := s.admit(s.queryGate, r)
+	if e != nil {
+		return e
+	}
+	keys, err := s.qs.APIKeys()
+	release()
+	if err != nil {
+		return internalError(err)
+	}
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		return internalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"arla/mutationstore"
+	"arla/schema"
+	"fmt"
+	"os"
+)
+
+// checkpoint appends a digest of the current state to the log. It must be
+// called with commitMu held so that no mutation is applied between the
+// last one logged and the digest.
+func (s *Server) checkpoint() error {
+	digest, err := s.qs.Digest()
+	if err != nil {
+		return err
+	}
+	m := &schema.Mutation{
+		ID:     schema.TimeUUID(),
+		Name:   schema.CheckpointMutation,
+		Digest: digest,
+		// the checkpoint's seq tells replay which mutations it covers
+		Meta: &schema.Meta{},
+	}
+	if s.info != nil {
+		m.Version = s.info.Version
+	}
+	position, err := s.ms.Append(m)
+	if err != nil {
+		return err
+	}
+	// the segments before a checkpoint are no longer written to or needed
+	// to verify a replay, so they can be archived
+	ms := s.ms
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		archiveLog(ms, position)
+	}()
+	return nil
+}
+
+// archiveLog compresses or moves away the log segments that end before
+// position if --log-archive-dir or --log-compress are set
+func archiveLog(ms *mutationstore.Log, position int64) {
+	n, err := ms.Archive(position)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+	if n > 0 {
+		fmt.Printf("archived %d mutation log segments\n", n)
+	}
+}
+
+// maybeCheckpoint writes a checkpoint every --checkpoint-interval mutations.
+// Failing to checkpoint does not fail the mutation that triggered it.
+func (s *Server) maybeCheckpoint(position int64) {
+	if s.cfg.CheckpointInterval <= 0 || position%int64(s.cfg.CheckpointInterval) != 0 {
+		return
+	}
+	if err := s.checkpoint(); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: failed to write checkpoint: %v\n", err)
+	}
+}
+
+// checkReplay reports the tables whose replayed contents did not match the
+// checkpoints in the log. With --strict-replay a divergence is an error.
+func (s *Server) checkReplay() error {
+	divergences, err := s.qs.Divergences()
+	if err != nil {
+		return err
+	}
+	for _, d := range divergences {
+		fmt.Printf("WARNING: replay diverged from checkpoint in table %s after mutations %d to %d (expected digest %s got %s)\n", d.Table, d.FromSeq, d.ToSeq, d.Expected, d.Actual)
+	}
+	if len(divergences) > 0 && s.cfg.StrictReplay {
+		d := divergences[0]
+		return fmt.Errorf("replay diverged from checkpoint in table %s after mutations %d to %d", d.Table, d.FromSeq, d.ToSeq)
+	}
+	return nil
+}
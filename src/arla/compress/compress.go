@@ -0,0 +1,175 @@
+// Package compress negotiates response compression with clients.
+//
+// Only gzip is currently supported as there is no brotli encoder available
+// to the build. Encodings are listed in order of preference so that others
+// can be added to Encoders.
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MinSize is the response size below which compression is not worthwhile
+const MinSize = 1024
+
+// Encoder creates a compressing writer
+type Encoder struct {
+	Name string
+	New  func(w io.Writer) io.WriteCloser
+}
+
+var gzipPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// pooledGzip returns its gzip.Writer to the pool when closed
+type pooledGzip struct {
+	*gzip.Writer
+}
+
+func (g pooledGzip) Close() error {
+	err := g.Writer.Close()
+	gzipPool.Put(g.Writer)
+	return err
+}
+
+// Encoders are the supported encodings in order of preference
+var Encoders = []Encoder{
+	{"gzip", func(w io.Writer) io.WriteCloser {
+		gz := gzipPool.Get().(*gzip.Writer)
+		gz.Reset(w)
+		return pooledGzip{gz}
+	}},
+}
+
+// Accepts returns true if the request's Accept-Encoding header allows the
+// encoding. Encodings with a quality of zero are refused.
+func Accepts(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if name := strings.TrimSpace(fields[0]); name != encoding && name != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Writer compresses the response if the client accepts one of the Encoders
+// and the body is at least MinSize. Close must be called once the handler
+// has finished writing.
+type Writer struct {
+	http.ResponseWriter
+	encoder *Encoder
+	status  int
+	buf     []byte
+	enc     io.WriteCloser
+	started bool
+}
+
+// NewWriter negotiates an encoding for the request
+func NewWriter(w http.ResponseWriter, r *http.Request) *Writer {
+	cw := &Writer{ResponseWriter: w}
+	w.Header().Add("Vary", "Accept-Encoding")
+	for i := range Encoders {
+		if Accepts(r, Encoders[i].Name) {
+			cw.encoder = &Encoders[i]
+			break
+		}
+	}
+	return cw
+}
+
+// WriteHeader delays writing the status until the encoding is decided
+func (w *Writer) WriteHeader(code int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	w.status = code
+	// responses without a body are never compressed
+	if code == http.StatusNotModified || code == http.StatusNoContent {
+		w.start(false)
+	}
+}
+
+// Write buffers until MinSize bytes have been written
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.started {
+		if w.enc != nil {
+			return w.enc.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	if w.encoder == nil {
+		w.start(false)
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= MinSize {
+		if err := w.flushBuffer(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start writes the headers, enabling compression if compress is true and
+// the handler has not already encoded the body itself.
+func (w *Writer) start(compress bool) {
+	w.started = true
+	h := w.Header()
+	if compress && w.encoder != nil && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", w.encoder.Name)
+		h.Del("Content-Length")
+		w.enc = w.encoder.New(w.ResponseWriter)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// flushBuffer starts the response and writes any buffered bytes
+func (w *Writer) flushBuffer(compress bool) error {
+	w.start(compress)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Close writes any buffered response uncompressed and flushes the encoder
+func (w *Writer) Close() error {
+	if !w.started {
+		return w.flushBuffer(false)
+	}
+	if w.enc != nil {
+		err := w.enc.Close()
+		w.enc = nil
+		return err
+	}
+	return nil
+}
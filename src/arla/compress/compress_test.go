@@ -0,0 +1,106 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// respond runs a handler through a Writer and returns the recorded response
+func respond(acceptEncoding string, fn func(w http.ResponseWriter)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/query", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	w := NewWriter(rec, r)
+	fn(w)
+	w.Close()
+	return rec
+}
+
+func TestAccepts(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		ok     bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"identity", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tc.header)
+		if Accepts(r, "gzip") != tc.ok {
+			t.Fatalf("expected Accepts(%q, gzip) to be %v", tc.header, tc.ok)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"},`, 200)
+	res := respond("gzip", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		// write in small pieces to check buffering
+		for i := 0; i < len(body); i += 100 {
+			end := i + 100
+			if end > len(body) {
+				end = len(body)
+			}
+			w.Write([]byte(body[i:end]))
+		}
+	})
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected status to be preserved got %d", res.Code)
+	}
+	if res.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected large response to be gzipped")
+	}
+	if res.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatal("expected Vary: Accept-Encoding")
+	}
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != body {
+		t.Fatal("expected decompressed body to match")
+	}
+}
+
+func TestNoCompress(t *testing.T) {
+	large := strings.Repeat("x", 2*MinSize)
+	for _, tc := range []struct {
+		name   string
+		accept string
+		status int
+		body   string
+	}{
+		{"client does not accept gzip", "", http.StatusOK, large},
+		{"small response", "gzip", http.StatusBadRequest, `{"error":"bad"}`},
+		{"not modified", "gzip", http.StatusNotModified, ""},
+	} {
+		res := respond(tc.accept, func(w http.ResponseWriter) {
+			w.WriteHeader(tc.status)
+			if tc.body != "" {
+				w.Write([]byte(tc.body))
+			}
+		})
+		if res.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("%s: expected response to not be compressed", tc.name)
+		}
+		if res.Code != tc.status || res.Body.String() != tc.body {
+			t.Fatalf("%s: expected %d %q got %d %q", tc.name, tc.status, tc.body, res.Code, res.Body.String())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy decides which cross-origin requests are allowed
+type corsPolicy struct {
+	origins     []string
+	credentials bool
+	maxAge      int
+	expose      string
+}
+
+// newCORSPolicy creates a corsPolicy from the server config
+func newCORSPolicy(cfg Config) *corsPolicy {
+	p := &corsPolicy{
+		origins:     cfg.CORSOrigins,
+		credentials: cfg.CORSCredentials,
+		maxAge:      cfg.CORSMaxAge,
+		expose:      strings.Join(cfg.CORSExposeHeaders, ", "),
+	}
+	for _, origin := range p.origins {
+		if p.credentials && origin == "*" {
+			fmt.Println("WARNING: credentialed CORS requests are allowed from any origin")
+		}
+	}
+	return p
+}
+
+// allowed returns true if origin matches one of the allowed origins.
+// Allowed origins may contain * wildcards (eg. https://*.example.com).
+func (p *corsPolicy) allowed(origin string) bool {
+	for _, pattern := range p.origins {
+		if matchWildcard(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard matches s against a pattern where * matches any run of characters
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// enableCORS sets headers to allow CORS if the request's origin is allowed.
+// It returns false if the request came from an origin that is not allowed.
+func (s *Server) enableCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	w.Header().Add("Vary", "Origin")
+	if !s.cors.allowed(origin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key, X-API-Version, X-Request-ID")
+	if s.cors.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if s.cors.maxAge > 0 && r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(s.cors.maxAge))
+	}
+	if s.cors.expose != "" {
+		w.Header().Set("Access-Control-Expose-Headers", s.cors.expose)
+	}
+	return true
+}
+
+// headerRule sets (or removes if value is empty) a header for all
+// paths beginning with prefix
+type headerRule struct {
+	prefix string
+	name   string
+	value  string
+}
+
+// securityHeaders is the policy of headers added to static file responses
+type securityHeaders []headerRule
+
+// newSecurityHeaders builds the header policy from the server config. The
+// global options apply to every path and SecurityHeaders rules are applied
+// on top in order of increasing prefix length so more specific rules win.
+func newSecurityHeaders(cfg Config) (securityHeaders, error) {
+	var rules securityHeaders
+	add := func(name, value string) {
+		if value != "" {
+			rules = append(rules, headerRule{prefix: "/", name: name, value: value})
+		}
+	}
+	if cfg.HSTSMaxAge > 0 {
+		add("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", cfg.HSTSMaxAge))
+	}
+	add("Content-Security-Policy", cfg.ContentSecurityPolicy)
+	add("X-Frame-Options", cfg.FrameOptions)
+	add("Referrer-Policy", cfg.ReferrerPolicy)
+	add("X-Content-Type-Options", "nosniff")
+	var custom securityHeaders
+	for _, s := range cfg.SecurityHeaders {
+		rule, err := parseHeaderRule(s)
+		if err != nil {
+			return nil, err
+		}
+		custom = append(custom, rule)
+	}
+	sort.SliceStable(custom, func(i, j int) bool {
+		return len(custom[i].prefix) < len(custom[j].prefix)
+	})
+	return append(rules, custom...), nil
+}
+
+// parseHeaderRule parses rules in the form "/prefix Name: value"
+func parseHeaderRule(s string) (headerRule, error) {
+	var rule headerRule
+	fields := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], "/") {
+		return rule, fmt.Errorf("invalid security header %q: expected '/prefix Name: value'", s)
+	}
+	kv := strings.SplitN(fields[1], ":", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return rule, fmt.Errorf("invalid security header %q: expected '/prefix Name: value'", s)
+	}
+	rule.prefix = fields[0]
+	rule.name = http.CanonicalHeaderKey(strings.TrimSpace(kv[0]))
+	rule.value = strings.TrimSpace(kv[1])
+	return rule, nil
+}
+
+// wrap returns a handler that sets the policy's headers before calling h
+func (sh securityHeaders) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range sh {
+			if !strings.HasPrefix(r.URL.Path, rule.prefix) {
+				continue
+			}
+			if rule.value == "" {
+				w.Header().Del(rule.name)
+			} else {
+				w.Header().Set(rule.name, rule.value)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
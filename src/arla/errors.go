@@ -4,17 +4,21 @@ import (
 	"arla/schema"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"strings"
+	"time"
 )
 
 import "github.com/jackc/pgx"
 
 // Error type used my HandleFunc
 type Error struct {
-	err     error
-	code    int
-	Message string `json:"error"`
+	err        error
+	code       int
+	retryAfter time.Duration
+	Message    string `json:"error"`
 	// QueryError fields
 	Line     int    `json:"line,omitempty"`
 	Column   int    `json:"column,omitempty"`
@@ -25,6 +29,16 @@ type Error struct {
 	Kind     string `json:"kind,omitempty"`
 	// MutationError fields
 	Mutation *schema.Mutation `json:"mutation,omitempty"`
+	// Index is the position of the failed mutation in a batch
+	Index *int `json:"index,omitempty"`
+	// rate limit fields
+	Limit      string `json:"limit,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	// timeout fields
+	Timeout int `json:"timeout_ms,omitempty"`
+	// api version fields
+	Version    int `json:"version,omitempty"`
+	MinVersion int `json:"min_version,omitempty"`
 }
 
 func (e *Error) Error() string {
@@ -79,6 +93,69 @@ func authError(err error) *Error {
 	}
 }
 
+// forbiddenError wraps an error with a 403 error and masks the
+// actual error message from the end-user completely
+func forbiddenError(err error) *Error {
+	return &Error{
+		err:     err,
+		code:    http.StatusForbidden,
+		Message: "you do not have permission to perform this request",
+	}
+}
+
+// rateLimitError wraps an error with a 429 status and tells the
+// client which limit was hit and how long to wait before retrying
+func rateLimitError(err error, limit string, retryAfter time.Duration) *Error {
+	return &Error{
+		err:        err,
+		code:       http.StatusTooManyRequests,
+		retryAfter: retryAfter,
+		Message:    "too many requests, please try again later",
+		Limit:      limit,
+		RetryAfter: int(math.Ceil(retryAfter.Seconds())),
+	}
+}
+
+// overloadedError wraps an error with a 503 status when a request could not
+// get a database connection in time
+func overloadedError(err error, retryAfter time.Duration) *Error {
+	return &Error{
+		err:        err,
+		code:       http.StatusServiceUnavailable,
+		retryAfter: retryAfter,
+		Message:    "server is too busy, please try again later",
+		RetryAfter: int(math.Ceil(retryAfter.Seconds())),
+	}
+}
+
+// timeoutError wraps an error with a 504 status when a request was not
+// completed within its time limit. Property names what was being evaluated.
+func timeoutError(err error, property string, timeout time.Duration) *Error {
+	msg := "the request took too long to process"
+	if property != "" {
+		msg = fmt.Sprintf("timed out evaluating %s", property)
+	}
+	return &Error{
+		err:      fmt.Errorf("%s: %v", msg, err),
+		code:     http.StatusGatewayTimeout,
+		Message:  msg,
+		Property: property,
+		Timeout:  int(timeout / time.Millisecond),
+	}
+}
+
+// versionError wraps an error with a 400 status when a client uses an api
+// version that is no longer supported
+func versionError(version, min int) *Error {
+	return &Error{
+		err:        fmt.Errorf("api version %d is older than the minimum %d", version, min),
+		code:       http.StatusBadRequest,
+		Message:    "this version of the app is no longer supported, please upgrade",
+		Version:    version,
+		MinVersion: min,
+	}
+}
+
 // If a request is in the middle of being processed when server is
 // shutdown or when qs or ms fails then return a "come back later" error
 func tempError() *Error {
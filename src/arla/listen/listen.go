@@ -0,0 +1,142 @@
+// Package listen opens network listeners from address strings. As well as
+// TCP addresses it supports Unix domain sockets and sockets passed in by a
+// service manager using the systemd socket activation protocol.
+//
+// Addresses take one of the forms:
+//
+//	:80, 127.0.0.1:8080     TCP address
+//	unix:/run/arla.sock     Unix domain socket
+//	systemd:name            inherited socket named in LISTEN_FDNAMES
+//	systemd:0               inherited socket by index
+package listen
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd:"
+	// listenFDsStart is the first file descriptor passed by systemd
+	listenFDsStart = 3
+)
+
+// IsUnix returns true if addr is a Unix domain socket address
+func IsUnix(addr string) bool {
+	return strings.HasPrefix(addr, unixPrefix)
+}
+
+// IsTCP returns true if addr is a plain TCP address
+func IsTCP(addr string) bool {
+	return !IsUnix(addr) && !strings.HasPrefix(addr, systemdPrefix)
+}
+
+// Listen opens a listener for addr. Unix sockets are created with the
+// given file mode, replacing any stale socket file left at the path.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	switch {
+	case IsUnix(addr):
+		return listenUnix(strings.TrimPrefix(addr, unixPrefix), mode)
+	case strings.HasPrefix(addr, systemdPrefix):
+		return Activated(strings.TrimPrefix(addr, systemdPrefix))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix creates a Unix domain socket at path
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("cannot listen on %s: file exists and is not a socket", path)
+		}
+		// only remove the socket if nothing is listening on it
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot listen on %s: socket is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+var (
+	activatedOnce sync.Once
+	activated     []*os.File
+	activatedErr  error
+)
+
+// Activated returns the inherited socket with the given name or index. The
+// environment variables are only read once and then cleared so that they
+// are not passed on to child processes.
+func Activated(name string) (net.Listener, error) {
+	activatedOnce.Do(func() {
+		activated, activatedErr = inherit(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), listenFDsStart)
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if activatedErr != nil {
+		return nil, activatedErr
+	}
+	f := find(activated, name)
+	if f == nil {
+		return nil, fmt.Errorf("no socket named %q was passed by the service manager", name)
+	}
+	return net.FileListener(f)
+}
+
+// inherit wraps the file descriptors passed to this process. Descriptors
+// intended for another process (LISTEN_PID does not match) are ignored.
+func inherit(pid, fds, names string, start int) ([]*os.File, error) {
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	var labels []string
+	if names != "" {
+		labels = strings.Split(names, ":")
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		label := "LISTEN_FD_" + strconv.Itoa(start+i)
+		if i < len(labels) && labels[i] != "" {
+			label = labels[i]
+		}
+		files[i] = os.NewFile(uintptr(start+i), label)
+	}
+	return files, nil
+}
+
+// find returns the file whose name or index matches name
+func find(files []*os.File, name string) *os.File {
+	for _, f := range files {
+		if f.Name() == name {
+			return f
+		}
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(files) {
+		return files[i]
+	}
+	return nil
+}
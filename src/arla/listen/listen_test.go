@@ -0,0 +1,97 @@
+package listen
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arlalisten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "arla.sock")
+	l, err := Listen("unix:"+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected socket mode 0600 got %v", fi.Mode().Perm())
+	}
+	if _, err := Listen("unix:"+path, 0600); err == nil {
+		t.Fatal("expected listening on a socket that is in use to fail")
+	}
+	l.Close()
+	// leave a stale socket file behind
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	l, err = Listen("unix:"+path, 0660)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced: %v", err)
+	}
+	l.Close()
+	// never remove regular files
+	file := filepath.Join(dir, "notasocket")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix:"+file, 0600); err == nil {
+		t.Fatal("expected listening over a regular file to fail")
+	}
+}
+
+func TestInherit(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pid := strconv.Itoa(os.Getpid())
+	fd := int(f.Fd())
+	// sockets for other processes are ignored
+	files, err := inherit("1", "1", "api", fd)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("expected sockets for another pid to be ignored got %v %v", files, err)
+	}
+	if _, err := inherit(pid, "x", "", fd); err == nil {
+		t.Fatal("expected invalid LISTEN_FDS to fail")
+	}
+	files, err = inherit(pid, "1", "api", fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if find(files, "admin") != nil {
+		t.Fatal("expected unknown name to not match")
+	}
+	if find(files, "0") != files[0] {
+		t.Fatal("expected socket to be found by index")
+	}
+	l, err := net.FileListener(find(files, "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"arla/mutationstore"
+	"arla/schema"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+import "github.com/jessevdk/go-flags"
+
+// logFilter selects records of a mutation log. Empty fields match
+// everything.
+type logFilter struct {
+	// RequestID matches the request the mutation was received in
+	RequestID string `json:"requestId"`
+	// User is the UserClaim of the submitter
+	User string `json:"user"`
+	// UserClaim is the token claim that User is compared with
+	UserClaim string `json:"-"`
+	// Action matches the mutation name or any mutation in a batch
+	Action string    `json:"action"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	// FromSeq and ToSeq limit the range of log positions
+	FromSeq int64 `json:"fromSeq"`
+	ToSeq   int64 `json:"toSeq"`
+}
+
+// mutationTime returns when the mutation was received (or rejected)
+func mutationTime(m *schema.Mutation) time.Time {
+	switch {
+	case m.Rejection != nil:
+		return m.Rejection.Time
+	case m.Meta != nil:
+		return m.Meta.Received
+	}
+	return m.ID.Time()
+}
+
+// mutationUser returns the claim of the session that submitted m that
+// identifies the user
+func mutationUser(m *schema.Mutation, claim string) string {
+	if m.Rejection != nil {
+		return m.Rejection.User
+	}
+	if id, ok := m.Token[claim]; ok && id != nil {
+		return fmt.Sprint(id)
+	}
+	return ""
+}
+
+// match returns true if m at position seq in its log is selected by f
+func (f *logFilter) match(m *schema.Mutation, seq int64) bool {
+	if f.FromSeq > 0 && seq < f.FromSeq {
+		return false
+	}
+	if f.ToSeq > 0 && seq > f.ToSeq {
+		return false
+	}
+	if f.RequestID != "" && (m.Meta == nil || m.Meta.RequestID != f.RequestID) {
+		return false
+	}
+	if f.User != "" && mutationUser(m, f.UserClaim) != f.User {
+		return false
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		t := mutationTime(m)
+		if !f.Since.IsZero() && t.Before(f.Since) {
+			return false
+		}
+		if !f.Until.IsZero() && !t.Before(f.Until) {
+			return false
+		}
+	}
+	if f.Action == "" || m.Name == f.Action {
+		return true
+	}
+	for _, b := range m.Batch {
+		if b.Name == f.Action {
+			return true
+		}
+	}
+	return false
+}
+
+// logShowCommand prints the records of a mutation log that match its
+// options as JSON lines
+type logShowCommand struct {
+	DataDir   string `long:"data-dir" description:"path to persistant data storage" default:"/var/state" env:"ARLA_DATA_DIR"`
+	Rejected  bool   `long:"rejected" description:"read the log of rejected mutations instead of the datastore"`
+	RequestID string `long:"request-id" description:"only show mutations received in the request with this id"`
+	User      string `long:"user" description:"only show mutations submitted by the session with this user claim"`
+	UserClaim string `long:"user-claim" description:"name of the token claim that uniquely identifies a user" default:"id" env:"ARLA_USER_CLAIM"`
+	Action    string `long:"action" description:"only show mutations of this action"`
+	Since     string `long:"since" description:"only show mutations received at or after this RFC3339 time"`
+	Until     string `long:"until" description:"only show mutations received before this RFC3339 time"`
+	FromSeq   int64  `long:"from-seq" description:"first log position to show"`
+	ToSeq     int64  `long:"to-seq" description:"last log position to show"`
+}
+
+// Execute implements flags.Commander
+func (c *logShowCommand) Execute(args []string) error {
+	f := logFilter{
+		RequestID: c.RequestID,
+		User:      c.User,
+		UserClaim: c.UserClaim,
+		Action:    c.Action,
+		FromSeq:   c.FromSeq,
+		ToSeq:     c.ToSeq,
+	}
+	var err error
+	if c.Since != "" {
+		if f.Since, err = time.Parse(time.RFC3339, c.Since); err != nil {
+			return err
+		}
+	}
+	if c.Until != "" {
+		if f.Until, err = time.Parse(time.RFC3339, c.Until); err != nil {
+			return err
+		}
+	}
+	name := "datastore"
+	if c.Rejected {
+		name = "rejected"
+	}
+	filename := filepath.Join(c.DataDir, name)
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+	l, err := mutationstore.OpenReadOnly(filename)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	enc := json.NewEncoder(os.Stdout)
+	var seq int64
+	var encErr error
+	err = l.Scan(func(m *schema.Mutation) bool {
+		seq++
+		if f.match(m, seq) {
+			encErr = enc.Encode(m)
+		}
+		return encErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return encErr
+}
+
+// logConvertCommand rewrites a mutation log with another codec
+type logConvertCommand struct {
+	DataDir  string `long:"data-dir" description:"path to persistant data storage" default:"/var/state" env:"ARLA_DATA_DIR"`
+	Rejected bool   `long:"rejected" description:"convert the log of rejected mutations instead of the datastore"`
+	Codec    string `long:"codec" description:"encoding to convert the log to (ndjson or gzip)" required:"true"`
+}
+
+// Execute implements flags.Commander
+func (c *logConvertCommand) Execute(args []string) error {
+	codec, err := mutationstore.CodecByName(c.Codec)
+	if err != nil {
+		return err
+	}
+	name := "datastore"
+	if c.Rejected {
+		name = "rejected"
+	}
+	filename := filepath.Join(c.DataDir, name)
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+	n, err := mutationstore.Convert(filename, codec)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("converted %d mutations in %s to %s, the original log was kept at %s.old\n", n, filename, codec.Name(), filename)
+	return nil
+}
+
+// runLogCommand runs the `arla log` tools for inspecting mutation logs
+func runLogCommand(args []string) error {
+	p := flags.NewNamedParser("arla log", flags.HelpFlag|flags.PassDoubleDash)
+	if _, err := p.AddCommand("show", "print mutation log records", "Prints the records of a mutation log that match the options as JSON lines.", &logShowCommand{}); err != nil {
+		return err
+	}
+	if _, err := p.AddCommand("convert", "change the encoding of a mutation log", "Rewrites a mutation log with another codec. The server must not be running.", &logConvertCommand{}); err != nil {
+		return err
+	}
+	_, err := p.ParseArgs(args)
+	return err
+}
@@ -1,15 +1,29 @@
 package main
 
 import (
+	"arla/acme"
+	"arla/admission"
+	"arla/certs"
+	"arla/compress"
+	"arla/listen"
 	"arla/mutationstore"
 	"arla/querystore"
+	"arla/ratelimit"
 	"arla/schema"
+	"arla/static"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -31,6 +45,15 @@ type HandlerFunc func(w http.ResponseWriter, r *http.Request) *Error
 // AuthenticatedHandlerFunc is a type of http.handler that requires authorization
 type AuthenticatedHandlerFunc func(w http.ResponseWriter, r *http.Request, t schema.Token) *Error
 
+// contextKey is the type of keys for values attached to request contexts
+type contextKey int
+
+// Request context keys
+const (
+	apiKeyContextKey contextKey = iota
+	sessionCookieContextKey
+)
+
 // Config holds options for the server
 type Config struct {
 	// ConfigPath is the filepath to the javascript server configuration
@@ -39,14 +62,140 @@ type Config struct {
 	Secret string `long:"secret" description:"secret to use for signing authentication tokens" required:"true" env:"ARLA_SECRET"`
 	// DataDir is the filepath to where data will be stored
 	DataDir string `long:"data-dir" description:"path to persistant data storage" default:"/var/state" required:"true" env:"ARLA_DATA_DIR"`
-	// ListenAddr is the address the HTTP server binds to
-	ListenAddr string `long:"listen-addr" description:"address and port to bind http server to" default:":80" required:"true" env:"ARLA_LISTEN_ADDR"`
+	// ListenAddr are the addresses the HTTP server binds to
+	ListenAddr []string `long:"listen-addr" description:"address to bind http server to as host:port, unix:/path or systemd:name (repeatable)" default:":80" required:"true" env:"ARLA_LISTEN_ADDR" env-delim:","`
 	// GraceDuration is the time allowed to finishing serving requests during shutdown
 	GraceDuration int `long:"grace-duration" description:"time allowed in seconds to finish serving requests during shutdown" default:"1" required:"true" env:"ARLA_GRACE_DURATION"`
 	// MaxConnections sets the number of database connections allowed
 	MaxConnections int `long:"max-connections" description:"max number of database connections" default:"100" required:"true" env:"ARLA_MAX_CONNECTIONS"`
+	// AuthConnections is the number of extra database connections reserved for authentication
+	AuthConnections int `long:"auth-connections" description:"number of extra database connections reserved for authentication and registration (0 shares the query connections)" default:"10" env:"ARLA_AUTH_CONNECTIONS"`
+	// QueueSize is the number of requests that may wait for a database connection
+	QueueSize int `long:"queue-size" description:"max number of requests waiting for a database connection before new ones are rejected" default:"100" env:"ARLA_QUEUE_SIZE"`
+	// QueueTimeout is how long a request may wait for a database connection
+	QueueTimeout int `long:"queue-timeout" description:"max time in milliseconds a request may wait for a database connection" default:"2000" env:"ARLA_QUEUE_TIMEOUT"`
+	// QueryTimeout is the time allowed for a query before it is cancelled
+	QueryTimeout int `long:"query-timeout" description:"max time in milliseconds for a query (0 disables), can be overridden per root property with timeouts in config.js" default:"30000" env:"ARLA_QUERY_TIMEOUT"`
+	// ExecTimeout is the time allowed for a mutation before it is cancelled
+	ExecTimeout int `long:"exec-timeout" description:"max time in milliseconds for a mutation (0 disables)" default:"10000" env:"ARLA_EXEC_TIMEOUT"`
+	// AuthTimeout is the time allowed for authentication and registration
+	AuthTimeout int `long:"auth-timeout" description:"max time in milliseconds for authentication or registration (0 disables)" default:"10000" env:"ARLA_AUTH_TIMEOUT"`
+	// PersistedQueriesDir is a directory of .aql files that clients can run by name
+	PersistedQueriesDir string `long:"persisted-queries-dir" description:"directory of .aql files to load as persisted queries (the file name is the query id)" env:"ARLA_PERSISTED_QUERIES_DIR"`
+	// PersistedQueriesOnly rejects queries that are not persisted
+	PersistedQueriesOnly bool `long:"persisted-queries-only" description:"only allow persisted queries to be run by id" env:"ARLA_PERSISTED_QUERIES_ONLY"`
+	// MinAPIVersion is the oldest api version clients may exec mutations with
+	MinAPIVersion int `long:"min-api-version" description:"oldest api version accepted from clients by /exec (0 accepts all)" env:"ARLA_MIN_API_VERSION"`
+	// CheckpointInterval is the number of log records between state digests
+	CheckpointInterval int `long:"checkpoint-interval" description:"number of mutations between digests of the data written to the log to verify replays (0 disables)" default:"1000" env:"ARLA_CHECKPOINT_INTERVAL"`
+	// LogSegmentSize is the size at which the mutation log starts a new segment file
+	LogSegmentSize int64 `long:"log-segment-size" description:"size in bytes at which the mutation log starts a new segment file (0 for no limit)" default:"67108864" env:"ARLA_LOG_SEGMENT_SIZE"`
+	// LogSegmentAge is how long a segment of the mutation log is written to
+	LogSegmentAge int `long:"log-segment-age" description:"time in seconds after which the mutation log starts a new segment file on the next write (0 for no limit)" default:"0" env:"ARLA_LOG_SEGMENT_AGE"`
+	// LogCodec is the encoding of new mutation log segments
+	LogCodec string `long:"log-codec" description:"encoding of new mutation log segments (ndjson or gzip), existing segments are read with the codec they were written with" default:"ndjson" env:"ARLA_LOG_CODEC"`
+	// LogArchiveDir is where sealed log segments covered by a checkpoint are moved
+	LogArchiveDir string `long:"log-archive-dir" description:"directory to move sealed mutation log segments to once a checkpoint follows them (they are still replayed from there)" env:"ARLA_LOG_ARCHIVE_DIR"`
+	// LogCompress gzips sealed log segments covered by a checkpoint
+	LogCompress bool `long:"log-compress" description:"gzip sealed mutation log segments once a checkpoint follows them" env:"ARLA_LOG_COMPRESS"`
+	// StrictReplay fails startup if a replay does not match a checkpoint
+	StrictReplay bool `long:"strict-replay" description:"fail to start if replaying the log does not reproduce the data recorded in a checkpoint" env:"ARLA_STRICT_REPLAY"`
+	// MaxBatchSize is the number of queries or mutations allowed in one batch
+	MaxBatchSize int `long:"max-batch-size" description:"max number of queries in a /batch request or mutations in a batch /exec (0 for no limit)" default:"20" env:"ARLA_MAX_BATCH_SIZE"`
+	// QueryCacheSize is the number of bytes of shared query results to keep in memory
+	QueryCacheSize int64 `long:"query-cache-size" description:"max bytes of cacheable query results to keep in memory (0 disables)" default:"67108864" env:"ARLA_QUERY_CACHE_SIZE"`
 	// Debug enables debug log messages
 	Debug bool `long:"debug" description:"enable verbose debug error logging"`
+	// AdminClaim is the name of the token claim that grants access to admin endpoints
+	AdminClaim string `long:"admin-claim" description:"name of the boolean token claim that grants admin access" default:"admin" env:"ARLA_ADMIN_CLAIM"`
+	// AuthIPRate limits the number of authentication/registration attempts from a single IP
+	AuthIPRate float64 `long:"auth-ip-rate" description:"max authenticate/register requests per minute per ip (0 disables)" default:"60" env:"ARLA_AUTH_IP_RATE"`
+	// AuthIPBurst is the number of attempts an IP can make in quick succession
+	AuthIPBurst int `long:"auth-ip-burst" description:"max burst of authenticate/register requests per ip" default:"20" env:"ARLA_AUTH_IP_BURST"`
+	// AuthUserRate limits the number of authentication/registration attempts for a single username
+	AuthUserRate float64 `long:"auth-user-rate" description:"max authenticate/register requests per minute per username (0 disables)" default:"10" env:"ARLA_AUTH_USER_RATE"`
+	// AuthUserBurst is the number of attempts for a username that can be made in quick succession
+	AuthUserBurst int `long:"auth-user-burst" description:"max burst of authenticate/register requests per username" default:"5" env:"ARLA_AUTH_USER_BURST"`
+	// AuthUsernameField is the field in the authenticate/register JSON that identifies the user
+	AuthUsernameField string `long:"auth-username-field" description:"name of the authenticate/register field used for per-username limits" default:"username" env:"ARLA_AUTH_USERNAME_FIELD"`
+	// LockoutThreshold is the number of consecutive failed logins before locking out a username
+	LockoutThreshold int `long:"lockout-threshold" description:"failed authentication attempts before lockout (0 disables)" default:"5" env:"ARLA_LOCKOUT_THRESHOLD"`
+	// LockoutDuration is the initial lockout time which doubles with each further failure
+	LockoutDuration int `long:"lockout-duration" description:"time in seconds of the first lockout, doubled on each further failure" default:"60" env:"ARLA_LOCKOUT_DURATION"`
+	// LockoutMaxDuration caps the lockout time
+	LockoutMaxDuration int `long:"lockout-max-duration" description:"max time in seconds a username can be locked out for" default:"3600" env:"ARLA_LOCKOUT_MAX_DURATION"`
+	// LockoutPersist saves lockout state to the DataDir so that it survives restarts
+	LockoutPersist bool `long:"lockout-persist" description:"persist lockout state to the data dir across restarts" env:"ARLA_LOCKOUT_PERSIST"`
+	// ExecRate limits the number of mutations per user
+	ExecRate float64 `long:"exec-rate" description:"max exec requests per minute per token (0 disables)" default:"0" env:"ARLA_EXEC_RATE"`
+	// ExecBurst is the number of mutations a user can make in quick succession
+	ExecBurst int `long:"exec-burst" description:"max burst of exec requests per token" default:"10" env:"ARLA_EXEC_BURST"`
+	// ExecIPRate limits the number of mutations per IP
+	ExecIPRate float64 `long:"exec-ip-rate" description:"max exec requests per minute per ip (0 disables)" default:"0" env:"ARLA_EXEC_IP_RATE"`
+	// ExecIPBurst is the number of mutations an IP can make in quick succession
+	ExecIPBurst int `long:"exec-ip-burst" description:"max burst of exec requests per ip" default:"20" env:"ARLA_EXEC_IP_BURST"`
+	// QueryRate limits the number of queries per user
+	QueryRate float64 `long:"query-rate" description:"max query requests per minute per token (0 disables)" default:"0" env:"ARLA_QUERY_RATE"`
+	// QueryBurst is the number of queries a user can make in quick succession
+	QueryBurst int `long:"query-burst" description:"max burst of query requests per token" default:"20" env:"ARLA_QUERY_BURST"`
+	// QueryIPRate limits the number of queries per IP
+	QueryIPRate float64 `long:"query-ip-rate" description:"max query requests per minute per ip (0 disables)" default:"0" env:"ARLA_QUERY_IP_RATE"`
+	// QueryIPBurst is the number of queries an IP can make in quick succession
+	QueryIPBurst int `long:"query-ip-burst" description:"max burst of query requests per ip" default:"40" env:"ARLA_QUERY_IP_BURST"`
+	// UserClaim is the token claim that uniquely identifies a user
+	UserClaim string `long:"user-claim" description:"name of the token claim that uniquely identifies a user" default:"id" env:"ARLA_USER_CLAIM"`
+	// CookieSessions lets browser apps ask for the access token as an HttpOnly cookie
+	CookieSessions bool `long:"cookie-sessions" description:"allow clients that log in with ?session=cookie to get their access token as an HttpOnly cookie, requiring CSRF tokens for state changes" env:"ARLA_COOKIE_SESSIONS"`
+	// CookieName is the name of the session cookie
+	CookieName string `long:"cookie-name" description:"name of the session cookie" default:"arla_session" env:"ARLA_COOKIE_NAME"`
+	// CookieInsecure allows session cookies to be sent over plain HTTP (for development only)
+	CookieInsecure bool `long:"cookie-insecure" description:"do not set the Secure flag on session cookies (development only)" env:"ARLA_COOKIE_INSECURE"`
+	// TOTPIssuer is the name shown in authenticator apps for two-factor authentication
+	TOTPIssuer string `long:"totp-issuer" description:"issuer name shown in authenticator apps for two-factor authentication" default:"Arla" env:"ARLA_TOTP_ISSUER"`
+	// CORSOrigins is the list of origins allowed to make cross-origin requests
+	CORSOrigins []string `long:"cors-origin" description:"origin allowed to make cross-origin requests, may contain * wildcards (repeatable)" default:"*" env:"ARLA_CORS_ORIGINS" env-delim:","`
+	// CORSCredentials allows cross-origin requests to include cookies
+	CORSCredentials bool `long:"cors-credentials" description:"allow credentialed cross-origin requests" env:"ARLA_CORS_CREDENTIALS"`
+	// CORSMaxAge is how long browsers may cache preflight responses
+	CORSMaxAge int `long:"cors-max-age" description:"time in seconds browsers may cache preflight responses" default:"0" env:"ARLA_CORS_MAX_AGE"`
+	// CORSExposeHeaders lists response headers that cross-origin scripts may read
+	CORSExposeHeaders []string `long:"cors-expose-header" description:"response header exposed to cross-origin requests (repeatable)" env:"ARLA_CORS_EXPOSE_HEADERS" env-delim:","`
+	// HSTSMaxAge enables the Strict-Transport-Security header for static files
+	HSTSMaxAge int `long:"hsts-max-age" description:"max-age in seconds for the Strict-Transport-Security header (0 disables)" default:"0" env:"ARLA_HSTS_MAX_AGE"`
+	// ContentSecurityPolicy is the Content-Security-Policy header for static files
+	ContentSecurityPolicy string `long:"content-security-policy" description:"Content-Security-Policy header for static files" env:"ARLA_CONTENT_SECURITY_POLICY"`
+	// FrameOptions is the X-Frame-Options header for static files
+	FrameOptions string `long:"frame-options" description:"X-Frame-Options header for static files" default:"SAMEORIGIN" env:"ARLA_FRAME_OPTIONS"`
+	// ReferrerPolicy is the Referrer-Policy header for static files
+	ReferrerPolicy string `long:"referrer-policy" description:"Referrer-Policy header for static files" default:"strict-origin-when-cross-origin" env:"ARLA_REFERRER_POLICY"`
+	// SecurityHeaders are per route prefix header overrides for static files
+	SecurityHeaders []string `long:"security-header" description:"static file header for a route prefix in the form '/prefix Name: value', an empty value removes the header (repeatable)" env:"ARLA_SECURITY_HEADERS" env-delim:";"`
+	// TLSCert is the path to a PEM encoded certificate chain, enabling https on ListenAddr
+	TLSCert string `long:"tls-cert" description:"path to PEM encoded certificate chain; serves https on listen-addr" env:"ARLA_TLS_CERT"`
+	// TLSKey is the path to the PEM encoded private key for TLSCert
+	TLSKey string `long:"tls-key" description:"path to PEM encoded private key for tls-cert" env:"ARLA_TLS_KEY"`
+	// TLSReloadInterval is how often the certificate files are checked for changes
+	TLSReloadInterval int `long:"tls-reload-interval" description:"time in seconds between checks for changed certificate files (0 to only reload on SIGHUP)" default:"60" env:"ARLA_TLS_RELOAD_INTERVAL"`
+	// RedirectAddr is the address of a plain http listener that redirects to https
+	RedirectAddr string `long:"redirect-addr" description:"address and port to bind an http server that redirects to https (eg. :80)" env:"ARLA_REDIRECT_ADDR"`
+	// ACMEDomains enables obtaining certificates automatically via ACME
+	ACMEDomains []string `long:"acme-domain" description:"domain to obtain a certificate for via ACME (repeatable, requires redirect-addr)" env:"ARLA_ACME_DOMAINS" env-delim:","`
+	// ACMEDirectory is the directory URL of the ACME certificate authority
+	ACMEDirectory string `long:"acme-directory" description:"ACME directory URL" default:"https://acme-v02.api.letsencrypt.org/directory" env:"ARLA_ACME_DIRECTORY"`
+	// ACMEEmail is the contact address registered with the certificate authority
+	ACMEEmail string `long:"acme-email" description:"contact email for the ACME account" env:"ARLA_ACME_EMAIL"`
+	// ACMERenewBefore is how long before expiry certificates are renewed
+	ACMERenewBefore int `long:"acme-renew-before" description:"days before expiry to renew ACME certificates" default:"30" env:"ARLA_ACME_RENEW_BEFORE"`
+	// PublicDir is the directory of client app files served at /
+	PublicDir string `long:"public-dir" description:"path to the client app's static files" default:"/app/public" env:"ARLA_PUBLIC_DIR"`
+	// SPAFallback serves index.html for unknown paths so that client-side routes can be deep linked
+	SPAFallback bool `long:"spa-fallback" description:"serve index.html for unknown page paths (for client-side routing)" env:"ARLA_SPA_FALLBACK"`
+	// InjectConfig adds the runtime config (eg. api version) to index.html as window.ARLA_CONFIG
+	InjectConfig bool `long:"inject-config" description:"inject runtime config into index.html as window.ARLA_CONFIG" env:"ARLA_INJECT_CONFIG"`
+	// SocketMode is the file mode that unix socket listeners are created with
+	SocketMode string `long:"socket-mode" description:"octal file mode for unix socket listeners" default:"0660" env:"ARLA_SOCKET_MODE"`
+	// AdminAddr moves the admin routes off the public listeners onto private ones
+	AdminAddr []string `long:"admin-addr" description:"address to bind a private listener for admin routes, removing them from listen-addr (repeatable)" env:"ARLA_ADMIN_ADDR" env-delim:","`
 }
 
 // Server is an HTTP server
@@ -56,9 +205,38 @@ type Server struct {
 	qs       querystore.Engine
 	ms       *mutationstore.Log
 	mux      *http.ServeMux
-	http     *graceful.Server
+	adminMux *http.ServeMux
+	static   http.Handler
+	cors     *corsPolicy
+	servers  []*graceful.Server
+	// instance identifies this run of the server for query ETags
+	instance string
+	certs    *certs.Reloader
+	acme     *acme.Manager
+	tlsStop  chan struct{}
 	wg       sync.WaitGroup
 	stopping bool
+	// brute-force protection for authenticate/register
+	authIPLimit   *ratelimit.Limiter
+	authUserLimit *ratelimit.Limiter
+	lockout       *ratelimit.Lockout
+	// per-user and per-ip limits for exec/query
+	execLimits   requestLimits
+	queryLimits  requestLimits
+	actionLimits map[string]*ratelimit.Limiter
+	// admission control for the query and auth connection pools
+	queryGate *admission.Gate
+	authGate  *admission.Gate
+	// versions counts mutations by client api version
+	versions versionUsage
+	// rejected logs mutations that failed, it is never replayed
+	rejected *mutationstore.Log
+	// now returns the current time for two-factor codes (replaceable for
+	// tests)
+	now func() time.Time
+	// commitMu keeps the order of the log the same as the order mutations
+	// are applied in, which checkpoints rely on
+	commitMu sync.Mutex
 }
 
 // Launch the querystore
@@ -68,9 +246,12 @@ func (s *Server) startQueryEngine() (err error) {
 	}
 	// init query store
 	qscfg := &querystore.Config{
-		Path:           s.cfg.ConfigPath,
-		MaxConnections: s.cfg.MaxConnections,
-		LogLevel:       querystore.DEBUG,
+		Path:            s.cfg.ConfigPath,
+		MaxConnections:  s.cfg.MaxConnections,
+		AuthConnections: s.cfg.AuthConnections,
+		CacheSize:       s.cfg.QueryCacheSize,
+		QueriesDir:      s.cfg.PersistedQueriesDir,
+		LogLevel:        querystore.DEBUG,
 	}
 	if s.cfg.Debug {
 		qscfg.LogLevel = querystore.DEBUG
@@ -96,6 +277,10 @@ func (s *Server) startQueryEngine() (err error) {
 		return err
 	}
 	fmt.Println("api version", s.info.Version)
+	s.actionLimits = make(map[string]*ratelimit.Limiter)
+	for name, l := range s.info.RateLimits {
+		s.actionLimits[name] = ratelimit.PerMinute(l.Rate, l.Burst)
+	}
 	return nil
 }
 
@@ -104,11 +289,29 @@ func (s *Server) startLog() (err error) {
 	if s.ms != nil {
 		return nil
 	}
+	var codec mutationstore.Codec
+	if s.cfg.LogCodec != "" {
+		if codec, err = mutationstore.CodecByName(s.cfg.LogCodec); err != nil {
+			return err
+		}
+	}
+	opts := mutationstore.Options{
+		SegmentSize: s.cfg.LogSegmentSize,
+		SegmentAge:  time.Duration(s.cfg.LogSegmentAge) * time.Second,
+		Codec:       codec,
+	}
 	filename := filepath.Join(s.cfg.DataDir, "datastore")
-	s.ms, err = mutationstore.Open(filename)
+	archived := opts
+	archived.ArchiveDir = s.cfg.LogArchiveDir
+	archived.Compress = s.cfg.LogCompress
+	s.ms, err = mutationstore.OpenWith(filename, archived)
 	if err != nil {
 		return fmt.Errorf("failed to start mutationstore: %s", err)
 	}
+	s.rejected, err = mutationstore.OpenWith(filepath.Join(s.cfg.DataDir, "rejected"), opts)
+	if err != nil {
+		return fmt.Errorf("failed to open rejected mutation log: %s", err)
+	}
 	return nil
 }
 
@@ -138,22 +341,52 @@ func (s *Server) replayLog() (err error) {
 	return nil
 }
 
-// login writes an access token to the writer if the user is authenticated
-func (s *Server) login(w http.ResponseWriter, vals string) *Error {
-	claims, err := s.qs.Authenticate(vals)
+// login writes an access token to the writer if the user is authenticated.
+// Users with two-factor authentication enabled get a challenge token instead.
+func (s *Server) login(w http.ResponseWriter, r *http.Request, vals string) *Error {
+	if s.qs == nil {
+		return tempError()
+	}
+	release, e := s.admit(s.authGate, r)
+	if e != nil {
+		return e
+	}
+	defer release()
+	ctx, cancel := withTimeout(r, millis(s.cfg.AuthTimeout))
+	defer cancel()
+	claims, err := s.qs.Authenticate(ctx, vals)
 	if err != nil {
+		if err := contextError(ctx, "authenticate"); err != nil {
+			return err
+		}
 		return authError(err)
 	}
+	// check for 2fa
+	if challenged, err := s.challengeTOTP(w, claims); err != nil || challenged {
+		return err
+	}
+	return s.issueToken(w, r, claims)
+}
+
+// issueToken writes a signed access token for the claims to the writer
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request, claims schema.Token) *Error {
 	// create JWT
 	token := jwt.New(jwt.SigningMethodHS256)
 	for k, v := range claims {
 		token.Claims[k] = v
 	}
-	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	exp := time.Now().Add(time.Hour * 72)
+	token.Claims["exp"] = exp.Unix()
 	accessToken, err := token.SignedString([]byte(s.cfg.Secret))
 	if err != nil {
 		return internalError(err)
 	}
+	// browser apps can ask for the token as a cookie instead
+	if cookie, err := s.cookieSessionParam(r); err != nil {
+		return err
+	} else if cookie {
+		return s.startSession(w, accessToken, exp)
+	}
 	enc := json.NewEncoder(w)
 	err = enc.Encode(&struct {
 		AccessToken string `json:"access_token,omitempty"`
@@ -175,38 +408,97 @@ func (s *Server) registrationHandler(w http.ResponseWriter, r *http.Request) *Er
 	if err != nil {
 		return userError(err)
 	}
+	if err := s.limitAuth(remoteIP(r), s.authUsername(b)); err != nil {
+		return err
+	}
 	if s.qs == nil {
 		return tempError()
 	}
 	// ask queryengine to register new user
-	m, err := s.qs.Register(string(b))
+	release, e := s.admit(s.authGate, r)
+	if e != nil {
+		return e
+	}
+	ctx, cancel := withTimeout(r, millis(s.cfg.AuthTimeout))
+	defer cancel()
+	m, err := s.qs.Register(ctx, string(b))
+	release()
 	if err != nil {
+		if err := contextError(ctx, "register"); err != nil {
+			return err
+		}
 		return userError(err)
 	}
+	if schema.IsSystemMutation(m.Name) {
+		return userError(fmt.Errorf("invalid registration mutation %s", m.Name))
+	}
+	if err := s.commit(ctx, m); err != nil {
+		return err
+	}
+	// login
+	return s.login(w, r, string(b))
+}
+
+// commit applies the mutation to the queryengine and then writes it to the
+// mutation log.
+func (s *Server) commit(ctx context.Context, m *schema.Mutation) *Error {
+	_, _, err := s.execute(ctx, m)
+	return err
+}
+
+// execute commits the mutation and returns the action's result and the
+// position of the mutation in the log. The mutation is given an ID and
+// metadata envelope if it does not have them.
+func (s *Server) execute(ctx context.Context, m *schema.Mutation) (json.RawMessage, int64, *Error) {
+	if !m.ID.Valid() {
+		m.ID = schema.TimeUUID()
+	}
+	s.addMeta(ctx, m)
 	// attempt the mutation
 	if s.qs == nil {
-		return tempError()
+		return nil, 0, tempError()
 	}
-	err = s.qs.Mutate(m)
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+	result, err := s.qs.Mutate(ctx, m)
 	if err != nil {
-		return userError(err)
+		if err := contextError(ctx, m.Name); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, userError(err)
 	}
 	// commit the mutation to the log
 	if s.ms == nil {
-		return tempError()
+		return nil, 0, tempError()
 	}
-	err = s.ms.Write(m)
+	position, err := s.ms.Append(m)
 	if err != nil {
-		return internalError(err)
+		return nil, 0, internalError(err)
 	}
-	// login
-	return s.login(w, string(b))
+	s.maybeCheckpoint(position)
+	return result, position, nil
+}
+
+// publicInfo is the part of the app's info that anyone can see
+type publicInfo struct {
+	Version   int      `json:"version"`
+	Mutations []string `json:"mutations"`
 }
 
-// infoHandler returns introspection info about the server.
+// infoHandler returns introspection info about the server. The rate limits,
+// cache policies, timeouts and persisted queries from the app config are
+// only returned to admins by adminInfoHandler.
 func (s *Server) infoHandler(w http.ResponseWriter, r *http.Request) *Error {
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(s.info); err != nil {
+	if err := enc.Encode(&publicInfo{Version: s.info.Version, Mutations: s.info.Mutations}); err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// adminInfoHandler returns all of the info from the app config
+func (s *Server) adminInfoHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	if err := json.NewEncoder(w).Encode(s.info); err != nil {
 		return internalError(err)
 	}
 	return nil
@@ -220,45 +512,197 @@ func (s *Server) authenticationHandler(w http.ResponseWriter, r *http.Request) *
 	if err != nil {
 		return userError(err)
 	}
-	return s.login(w, string(b))
+	ip := remoteIP(r)
+	username := s.authUsername(b)
+	if err := s.checkLockout(ip, username); err != nil {
+		return err
+	}
+	if err := s.limitAuth(ip, username); err != nil {
+		return err
+	}
+	if err := s.login(w, r, string(b)); err != nil {
+		if err.code == http.StatusUnauthorized {
+			s.authFailed(ip, username)
+		}
+		return err
+	}
+	s.lockout.Reset(lockoutKey(ip, username))
+	return nil
 }
 
 // execHandler reads a Mutation JSON from the request body, executes it
 // in the queryengine, writes it to disk in via the mutation log and returns
 // a status of whether that was all a success or not.
 func (s *Server) execHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
-	// read the mutation json
-	var m schema.Mutation
-	err := json.NewDecoder(r.Body).Decode(&m)
+	dryRun, err := dryRunParam(r)
 	if err != nil {
+		return err
+	}
+	// read the mutation json
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		return userError(err)
 	}
-	m.Token = t
-	// send to query engine
-	if s.qs == nil {
-		return tempError()
+	if b := bytes.TrimSpace(body); len(b) > 0 && b[0] == '[' {
+		return s.execBatch(w, r, t, body, dryRun)
 	}
-	err = s.qs.Mutate(&m)
-	if err != nil {
+	var c clientMutation
+	if err := json.Unmarshal(body, &c); err != nil {
 		return userError(err)
 	}
-	// write to store
-	if s.ms == nil {
-		return tempError()
+	// everything else about the mutation is set by the server
+	m := schema.Mutation{Name: c.Name, Args: c.Args, Version: c.Version, Token: t}
+	if m.Version, err = s.apiVersion(r, m.Version); err != nil {
+		return err
+	}
+	if err := s.checkMutation(r, t, &m); err != nil {
+		return err
 	}
-	err = s.ms.Write(&m)
+	if err := s.limitAction(r, t, m.Name, dryRun); err != nil {
+		return err
+	}
+	res, err := s.apply(r, &m, dryRun)
 	if err != nil {
-		return userError(err)
+		return err
 	}
-	// return ok
-	err = json.NewEncoder(w).Encode(&struct {
-		// ID      schema.UUID `json:"id,omitempty"`
-		Success bool `json:"success"`
-	}{
-		// ID:      m.ID,
-		Success: true,
-	})
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// clientMutation is the part of a mutation that clients send to /exec
+type clientMutation struct {
+	Name    string        `json:"name"`
+	Args    []interface{} `json:"args"`
+	Version int           `json:"version"`
+}
+
+// dryRunParam reads the dryRun query string parameter
+func dryRunParam(r *http.Request) (bool, *Error) {
+	v := r.URL.Query().Get("dryRun")
+	if v == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, userError(fmt.Errorf("invalid dryRun value %q", v))
+	}
+	return dryRun, nil
+}
+
+// execResponse is the response of a successful /exec. Result is the JSON
+// returned by the action and Position is where the mutation was logged,
+// which can be compared with the ETag of later queries. A dry run has no
+// ID or Position as nothing was logged.
+type execResponse struct {
+	Success  bool            `json:"success"`
+	DryRun   bool            `json:"dryRun,omitempty"`
+	ID       *schema.UUID    `json:"id,omitempty"`
+	Position int64           `json:"position,omitempty"`
+	Result   json.RawMessage `json:"result"`
+	// Results holds the result of each mutation of a batch
+	Results []json.RawMessage `json:"results,omitempty"`
+}
+
+// apply commits m, or if dryRun is set runs it without committing or
+// logging it to find out whether it would succeed and what it returns.
+func (s *Server) apply(r *http.Request, m *schema.Mutation, dryRun bool) (*execResponse, *Error) {
+	ctx, cancel := withTimeout(r, millis(s.cfg.ExecTimeout))
+	defer cancel()
+	if !dryRun {
+		result, position, err := s.execute(ctx, m)
+		if err != nil {
+			s.reject(m, err)
+			return nil, err
+		}
+		id := m.ID
+		return &execResponse{Success: true, ID: &id, Position: position, Result: result}, nil
+	}
+	if s.qs == nil {
+		return nil, tempError()
+	}
+	// dry runs use a query connection
+	release, e := s.admit(s.queryGate, r)
+	if e != nil {
+		return nil, e
+	}
+	defer release()
+	s.addMeta(ctx, m)
+	result, err := s.qs.DryRun(ctx, m)
 	if err != nil {
+		if err := contextError(ctx, m.Name); err != nil {
+			return nil, err
+		}
+		return nil, userError(err)
+	}
+	return &execResponse{Success: true, DryRun: true, Result: result}, nil
+}
+
+// checkMutation returns an error if the request may not exec m
+func (s *Server) checkMutation(r *http.Request, t schema.Token, m *schema.Mutation) *Error {
+	// system mutations can only be generated by the server
+	if schema.IsSystemMutation(m.Name) {
+		return userError(fmt.Errorf("invalid action name %s", m.Name))
+	}
+	// api keys may be restricted to a set of actions
+	if k := requestAPIKey(r); k != nil && !k.AllowsAction(m.Name) {
+		return forbiddenError(fmt.Errorf("api key %s cannot exec %s", k.ID, m.Name))
+	}
+	return nil
+}
+
+// execBatch applies an array of mutations in order in one transaction. The
+// batch is logged as a single BatchMutation so it is replayed all or
+// nothing. If a mutation fails none are applied and the error's index
+// names the mutation that failed.
+func (s *Server) execBatch(w http.ResponseWriter, r *http.Request, t schema.Token, body json.RawMessage, dryRun bool) *Error {
+	var items []*clientMutation
+	if err := json.Unmarshal(body, &items); err != nil {
+		return userError(err)
+	}
+	batch := make([]*schema.Mutation, len(items))
+	if len(batch) == 0 {
+		return userError(fmt.Errorf("batch must contain at least one mutation"))
+	}
+	if s.cfg.MaxBatchSize > 0 && len(batch) > s.cfg.MaxBatchSize {
+		return userError(fmt.Errorf("batch of %d mutations exceeds the limit of %d", len(batch), s.cfg.MaxBatchSize))
+	}
+	for i, c := range items {
+		if c == nil {
+			return userError(fmt.Errorf("batch item %d is not a mutation", i))
+		}
+		// the batch's session and version apply to every mutation
+		batch[i] = &schema.Mutation{Name: c.Name, Args: c.Args}
+		if err := s.checkMutation(r, t, batch[i]); err != nil {
+			return err
+		}
+	}
+	// each mutation in the batch counts against the rate limits
+	for _, m := range batch {
+		if err := s.limitAction(r, t, m.Name, dryRun); err != nil {
+			return err
+		}
+	}
+	version, e := s.apiVersion(r, 0)
+	if e != nil {
+		return e
+	}
+	m := &schema.Mutation{
+		Name:    schema.BatchMutation,
+		Version: version,
+		Token:   t,
+		Batch:   batch,
+	}
+	res, e := s.apply(r, m, dryRun)
+	if e != nil {
+		return e
+	}
+	if err := json.Unmarshal(res.Result, &res.Results); err != nil || len(res.Results) != len(batch) {
+		return internalError(fmt.Errorf("batch returned %s", res.Result))
+	}
+	res.Result = nil
+	if err := json.NewEncoder(w).Encode(res); err != nil {
 		return internalError(err)
 	}
 	return nil
@@ -273,23 +717,202 @@ func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request, t schema.T
 	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
 		return userError(err)
 	}
-	if s.qs == nil {
+	if err := s.limitRequest(r, t, "query", s.queryLimits); err != nil {
+		return err
+	}
+	if s.qs == nil || s.ms == nil {
+		return tempError()
+	}
+	if q.ID != "" {
+		text, ok := s.qs.PersistedQuery(q.ID)
+		if !ok {
+			return userError(fmt.Errorf("unknown query id %s", q.ID))
+		}
+		q.Query = text
+	} else if s.cfg.PersistedQueriesOnly {
+		return forbiddenError(fmt.Errorf("only persisted queries are allowed"))
+	}
+	etag, err := s.queryETag(q)
+	if err != nil {
+		return internalError(err)
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	release, e := s.admit(s.queryGate, r)
+	if e != nil {
+		return e
+	}
+	defer release()
+	timeout, property, err := s.queryTimeout(r, q.Query)
+	if err != nil {
+		return userError(err)
+	}
+	ctx, cancel := withTimeout(r, timeout)
+	defer cancel()
+	if err := s.qs.Query(ctx, q, w); err != nil {
+		if err := contextError(ctx, property); err != nil {
+			return err
+		}
+		return userError(err)
+	}
+	return nil
+}
+
+// batchResult is an item of the /batch response. It holds either the
+// result of a query as data or the fields of the query's Error.
+type batchResult struct {
+	Data json.RawMessage `json:"data,omitempty"`
+	*Error
+}
+
+// batchHandler runs an array of queries against one consistent snapshot of
+// the data. Each item of the response holds the result or the error of the
+// query at the same position.
+func (s *Server) batchHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	var queries []*schema.Query
+	if err := json.NewDecoder(r.Body).Decode(&queries); err != nil {
+		return userError(err)
+	}
+	if len(queries) == 0 {
+		return userError(fmt.Errorf("batch must contain at least one query"))
+	}
+	if s.cfg.MaxBatchSize > 0 && len(queries) > s.cfg.MaxBatchSize {
+		return userError(fmt.Errorf("batch of %d queries exceeds the limit of %d", len(queries), s.cfg.MaxBatchSize))
+	}
+	// each query in the batch counts against the query rate limits
+	for range queries {
+		if err := s.limitRequest(r, t, "query", s.queryLimits); err != nil {
+			return err
+		}
+	}
+	if s.qs == nil || s.ms == nil {
 		return tempError()
 	}
-	if err := s.qs.Query(q, w); err != nil {
+	// the persisted text is resolved first so that ad-hoc text is never
+	// parsed when only persisted queries are allowed
+	unknown := make([]*Error, len(queries))
+	for i, q := range queries {
+		if q == nil {
+			return userError(fmt.Errorf("batch item %d is not a query", i))
+		}
+		q.Token = t
+		if q.ID != "" {
+			text, ok := s.qs.PersistedQuery(q.ID)
+			if !ok {
+				unknown[i] = userError(fmt.Errorf("unknown query id %s", q.ID))
+				continue
+			}
+			q.Query = text
+		} else if s.cfg.PersistedQueriesOnly {
+			return forbiddenError(fmt.Errorf("only persisted queries are allowed"))
+		}
+	}
+	// finding the timeouts parses the queries so they must be admitted first
+	release, e := s.admit(s.queryGate, r)
+	if e != nil {
+		return e
+	}
+	defer release()
+	var timeout time.Duration
+	var property string
+	for i, q := range queries {
+		if unknown[i] != nil {
+			continue
+		}
+		// a query that cannot be parsed is allowed the default and reports
+		// its error in its own item of the response
+		d, prop, _ := s.queryTimeout(r, q.Query)
+		if d > 0 && (timeout <= 0 || d < timeout) {
+			timeout, property = d, prop
+		}
+	}
+	ctx, cancel := withTimeout(r, timeout)
+	defer cancel()
+	results, errs, err := s.qs.QueryBatch(ctx, queries)
+	if err != nil {
+		if err := contextError(ctx, property); err != nil {
+			return err
+		}
 		return userError(err)
 	}
+	out := make([]batchResult, len(queries))
+	for i := range queries {
+		if unknown[i] != nil {
+			out[i].Error = unknown[i]
+			continue
+		}
+		if errs[i] != nil {
+			out[i].Error = userError(errs[i])
+			continue
+		}
+		out[i].Data = results[i]
+	}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		return internalError(err)
+	}
 	return nil
 }
 
-// enableCORS sets headers to allow CORS.
-// XXX: by default we allow CORS requests ... but there should be a way to configure it.
-func (s *Server) enableCORS(w http.ResponseWriter, r *http.Request) {
-	if origin := r.Header.Get("Origin"); origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+// metricsHandler returns counters describing the server's caches and
+// connection pool queues
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	if s.qs == nil {
+		return tempError()
+	}
+	metrics := map[string]interface{}{
+		"queryCache": s.qs.CacheStats(),
+		"admission": map[string]admission.Stats{
+			"query": s.queryGate.Stats(),
+			"auth":  s.authGate.Stats(),
+		},
+		"apiVersions": s.versions.Stats(),
 	}
+	if err := json.NewEncoder(w).Encode(metrics); err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// queryETag identifies the result of a query. Results can only change when
+// a mutation is committed, so the tag covers the query, its args, the claims
+// it runs with and the position of the log. The position must be read
+// before running the query so that a tag never claims to include mutations
+// that the result does not. The instance ID invalidates tags from before a
+// restart in case the app config has changed.
+func (s *Server) queryETag(q *schema.Query) (string, error) {
+	b, err := json.Marshal(&struct {
+		Instance string        `json:"instance"`
+		Position int64         `json:"position"`
+		Query    string        `json:"query"`
+		Args     []interface{} `json:"args"`
+		Token    schema.Token  `json:"token"`
+	}{
+		Instance: s.instance,
+		Position: s.ms.Len(),
+		Query:    q.Query,
+		Args:     q.Args,
+		Token:    q.Token,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return strconv.Quote(hex.EncodeToString(sum[:16])), nil
+}
+
+// etagMatch returns true if the If-None-Match header contains etag
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 // addHandler attaches a HandleFunc to the http server.
@@ -297,11 +920,23 @@ func (s *Server) addHandler(path string, fn HandlerFunc) {
 	s.mux.HandleFunc(path, s.wrapHandler(fn))
 }
 
+// addPrivateHandler attaches a HandleFunc to the admin listeners if there
+// are any, otherwise to the public http server.
+func (s *Server) addPrivateHandler(path string, fn HandlerFunc) {
+	s.adminMux.HandleFunc(path, s.wrapHandler(fn))
+}
+
 // addAuthenticatedHandler attaches a AuthenticatedHandleFunc to the http server
 func (s *Server) addAuthenticatedHandler(path string, fn AuthenticatedHandlerFunc) {
 	s.addHandler(path, s.wrapAuthenticatedHandler(fn))
 }
 
+// addAdminHandler attaches an AuthenticatedHandleFunc to the http server that
+// can only be called by users with the admin claim
+func (s *Server) addAdminHandler(path string, fn AuthenticatedHandlerFunc) {
+	s.addPrivateHandler(path, s.wrapAuthenticatedHandler(s.wrapCSRFHandler(s.wrapAdminHandler(fn))))
+}
+
 // wrapHandler converts our HandlerFunc into an http.HandlerFunc.
 // It ensures that the error responses are always JSON encoded
 func (s *Server) wrapHandler(fn HandlerFunc) http.HandlerFunc {
@@ -309,36 +944,58 @@ func (s *Server) wrapHandler(fn HandlerFunc) http.HandlerFunc {
 		// set default response type
 		w.Header().Set("Content-Type", ApplicationJSON)
 		// enable CORS
-		s.enableCORS(w, r)
+		allowed := s.enableCORS(w, r)
 		if r.Method == "OPTIONS" {
+			if !allowed {
+				s.writeError(w, forbiddenError(fmt.Errorf("origin %s not allowed", r.Header.Get("Origin"))))
+			}
 			return
 		}
+		r = withRequestMeta(w, r)
+		// compress the response if the client supports it
+		cw := compress.NewWriter(w, r)
+		defer cw.Close()
 		// call handler
-		if err := fn(w, r); err != nil {
-			// handle errors
-			if s.cfg.Debug {
-				fmt.Fprintf(os.Stderr, "DEBUG: %v", err)
-			}
-			w.WriteHeader(err.code)
-			enc := json.NewEncoder(w)
-			if fatal := enc.Encode(err); fatal != nil {
-				fmt.Fprintf(os.Stderr, "error during error handling: %v", fatal)
-				return
-			}
+		if err := fn(cw, r); err != nil {
+			s.writeError(cw, err)
 		}
 	}
 }
 
+// writeError writes the JSON encoded error to the response
+func (s *Server) writeError(w http.ResponseWriter, err *Error) {
+	if s.cfg.Debug {
+		fmt.Fprintf(os.Stderr, "DEBUG: %v", err)
+	}
+	if err.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(err.RetryAfter))
+	}
+	w.WriteHeader(err.code)
+	enc := json.NewEncoder(w)
+	if fatal := enc.Encode(err); fatal != nil {
+		fmt.Fprintf(os.Stderr, "error during error handling: %v", fatal)
+	}
+}
+
 // wrapAuthenticatedHandler converts an AuthenticatedHandleFunc to a HandlerFunc
 func (s *Server) wrapAuthenticatedHandler(fn AuthenticatedHandlerFunc) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) *Error {
+		// api keys take the place of a token
+		if key := apiKeyFromRequest(r); key != "" {
+			r, t, err := s.authenticateAPIKey(r, key)
+			if err != nil {
+				return err
+			}
+			return fn(w, r, t)
+		}
 		// get token from request
-		token, err := jwt.ParseFromRequest(r, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		token, err := jwt.ParseFromRequest(r, s.tokenKey)
+		if err == jwt.ErrNoTokenInRequest && s.cfg.CookieSessions {
+			if c, cerr := r.Cookie(s.cfg.CookieName); cerr == nil {
+				token, err = jwt.Parse(c.Value, s.tokenKey)
+				r = r.WithContext(context.WithValue(r.Context(), sessionCookieContextKey, true))
 			}
-			return []byte(s.cfg.Secret), nil
-		})
+		}
 		if err != nil {
 			return authError(err)
 		}
@@ -358,34 +1015,156 @@ func (s *Server) wrapAuthenticatedHandler(fn AuthenticatedHandlerFunc) HandlerFu
 	}
 }
 
-// startHTTP launches the http server
+// tokenKey is the jwt.Keyfunc used to verify access tokens
+func (s *Server) tokenKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return []byte(s.cfg.Secret), nil
+}
+
+// wrapAdminHandler ensures the token has the admin claim before calling fn
+func (s *Server) wrapAdminHandler(fn AuthenticatedHandlerFunc) AuthenticatedHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+		if admin, _ := t[s.cfg.AdminClaim].(bool); !admin {
+			return forbiddenError(fmt.Errorf("token does not have %s claim", s.cfg.AdminClaim))
+		}
+		return fn(w, r, t)
+	}
+}
+
+// startStatic configures the static file server
+func (s *Server) startStatic() error {
+	headers, err := newSecurityHeaders(s.cfg)
+	if err != nil {
+		return err
+	}
+	h := &static.Handler{
+		Dir: s.cfg.PublicDir,
+		SPA: s.cfg.SPAFallback,
+	}
+	if s.cfg.InjectConfig {
+		h.Config = s.runtimeConfig
+	}
+	s.static = headers.wrap(h)
+	return nil
+}
+
+// runtimeConfig is the config injected into the client app's index.html
+func (s *Server) runtimeConfig() interface{} {
+	cfg := struct {
+		APIVersion int `json:"apiVersion"`
+	}{}
+	if s.info != nil {
+		cfg.APIVersion = s.info.Version
+	}
+	return cfg
+}
+
+// serveStatic serves files for the client app
+func (s *Server) serveStatic(w http.ResponseWriter, r *http.Request) {
+	if s.static == nil {
+		http.Error(w, "Service is temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	s.static.ServeHTTP(w, r)
+}
+
+// startHTTP opens every listener and starts serving on them. TLS is used
+// for all public listeners except unix sockets.
 func (s *Server) startHTTP() error {
-	if s.http != nil {
+	if len(s.servers) > 0 {
 		return nil
 	}
+	tlsConfig, err := s.startTLS()
+	if err != nil {
+		return err
+	}
+	mode := uint64(0660)
+	if s.cfg.SocketMode != "" {
+		if mode, err = strconv.ParseUint(s.cfg.SocketMode, 8, 32); err != nil {
+			return fmt.Errorf("invalid socket-mode %q: %v", s.cfg.SocketMode, err)
+		}
+	}
+	addrs := s.cfg.ListenAddr
+	if len(addrs) == 0 {
+		addrs = []string{":http"}
+	}
+	for _, addr := range addrs {
+		l, err := listen.Listen(addr, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		cfg := tlsConfig
+		if listen.IsUnix(addr) {
+			cfg = nil
+		}
+		if err := s.serve(addr, l, s.mux, cfg); err != nil {
+			return err
+		}
+	}
+	for _, addr := range s.cfg.AdminAddr {
+		l, err := listen.Listen(addr, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		if err := s.serve(addr, l, s.adminMux, nil); err != nil {
+			return err
+		}
+	}
+	if s.cfg.RedirectAddr != "" {
+		l, err := listen.Listen(s.cfg.RedirectAddr, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		if err := s.serve(s.cfg.RedirectAddr, l, s.redirectMux(), nil); err != nil {
+			return err
+		}
+	}
+	if s.tlsStop != nil {
+		stop := s.tlsStop
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.watchCerts(stop)
+		}()
+	}
+	return nil
+}
+
+// serve handles requests from the listener until the server is stopped.
+// If tlsConfig is not nil connections are served over https with HTTP/2.
+func (s *Server) serve(addr string, l net.Listener, h http.Handler, tlsConfig *tls.Config) error {
+	hs := &http.Server{
+		Handler: h,
+	}
+	if tlsConfig != nil {
+		if err := configureTLS(hs, tlsConfig); err != nil {
+			l.Close()
+			return err
+		}
+		l = tls.NewListener(l, hs.TLSConfig)
+	}
 	shutdownExpected := false
-	s.http = &graceful.Server{
+	srv := &graceful.Server{
 		Timeout: time.Duration(s.cfg.GraceDuration) * time.Second,
-		Server: &http.Server{
-			Addr:    s.cfg.ListenAddr,
-			Handler: s.mux,
-		},
+		Server:  hs,
 		ShutdownInitiated: func() {
-			fmt.Println("http server shutting down")
+			fmt.Println("http server shutting down", addr)
 			shutdownExpected = true
 		},
 	}
+	s.servers = append(s.servers, srv)
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		fmt.Println("http server started")
-		if err := s.http.ListenAndServe(); err != nil {
+		fmt.Println("http server listening on", addr)
+		if err := srv.Serve(l); err != nil {
 			if !shutdownExpected {
-				fmt.Println("ListenAndServe: ", err)
+				fmt.Println("Serve: ", err)
 			}
 		}
-		s.http = nil
-		fmt.Println("http server shutdown")
+		fmt.Println("http server shutdown", addr)
 	}()
 	return nil
 }
@@ -403,10 +1182,20 @@ func (s *Server) Start() (err error) {
 	if err = s.startLog(); err != nil {
 		return
 	}
+	if err = s.loadLockouts(); err != nil {
+		return
+	}
+	if err = s.startStatic(); err != nil {
+		return
+	}
 	if err = s.replayLog(); err != nil {
 		fmt.Println("FAILED TO REPLAY MUTATIONS", err)
 		return
 	}
+	if err = s.checkReplay(); err != nil {
+		fmt.Println("FAILED TO VERIFY REPLAY", err)
+		return
+	}
 	if err = s.startHTTP(); err != nil {
 		return
 	}
@@ -437,9 +1226,17 @@ func (s *Server) Stop() error {
 		s.stopping = false
 	}()
 	var errs []string
-	if s.http != nil {
-		s.http.Stop(1 * time.Second)
-		s.http = nil
+	grace := time.Duration(s.cfg.GraceDuration) * time.Second
+	if grace <= 0 {
+		grace = 1 * time.Second
+	}
+	for _, srv := range s.servers {
+		srv.Stop(grace)
+	}
+	s.servers = nil
+	if s.tlsStop != nil {
+		close(s.tlsStop)
+		s.tlsStop = nil
 	}
 	if s.qs != nil {
 		if err := s.qs.Stop(); err != nil {
@@ -447,12 +1244,23 @@ func (s *Server) Stop() error {
 		}
 		s.qs = nil
 	}
+	// wait for the servers to drain and for any archiving of the log
+	s.wg.Wait()
 	if s.ms != nil {
 		if err := s.ms.Close(); err != nil {
 			errs = append(errs, err.Error())
 		}
 		s.ms = nil
 	}
+	if s.rejected != nil {
+		if err := s.rejected.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+		s.rejected = nil
+	}
+	if err := s.saveLockouts(); err != nil {
+		errs = append(errs, err.Error())
+	}
 	if err := s.Wait(); err != nil {
 		errs = append(errs, err.Error())
 	}
@@ -464,20 +1272,79 @@ func (s *Server) Stop() error {
 
 // New creates a new server with all required fields set
 func New(cfg Config) *Server {
+	// an empty claim name would never match so default it when the config
+	// was not parsed by go-flags
+	if cfg.AdminClaim == "" {
+		cfg.AdminClaim = "admin"
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "id"
+	}
+	if cfg.CookieName == "" {
+		cfg.CookieName = "arla_session"
+	}
 	s := &Server{
-		cfg: cfg,
-		mux: http.NewServeMux(),
+		cfg:           cfg,
+		mux:           http.NewServeMux(),
+		now:           time.Now,
+		instance:      schema.TimeUUID().String(),
+		cors:          newCORSPolicy(cfg),
+		authIPLimit:   ratelimit.PerMinute(cfg.AuthIPRate, cfg.AuthIPBurst),
+		authUserLimit: ratelimit.PerMinute(cfg.AuthUserRate, cfg.AuthUserBurst),
+		lockout: ratelimit.NewLockout(
+			cfg.LockoutThreshold,
+			time.Duration(cfg.LockoutDuration)*time.Second,
+			time.Duration(cfg.LockoutMaxDuration)*time.Second,
+		),
+		execLimits: requestLimits{
+			token: ratelimit.PerMinute(cfg.ExecRate, cfg.ExecBurst),
+			ip:    ratelimit.PerMinute(cfg.ExecIPRate, cfg.ExecIPBurst),
+		},
+		queryLimits: requestLimits{
+			token: ratelimit.PerMinute(cfg.QueryRate, cfg.QueryBurst),
+			ip:    ratelimit.PerMinute(cfg.QueryIPRate, cfg.QueryIPBurst),
+		},
+	}
+	queueTimeout := time.Duration(cfg.QueueTimeout) * time.Millisecond
+	s.queryGate = admission.New(cfg.MaxConnections, cfg.QueueSize, queueTimeout)
+	s.authGate = s.queryGate
+	if cfg.AuthConnections > 0 {
+		s.authGate = admission.New(cfg.AuthConnections, cfg.QueueSize, queueTimeout)
+	}
+	s.adminMux = s.mux
+	if len(cfg.AdminAddr) > 0 {
+		s.adminMux = http.NewServeMux()
 	}
 	s.addHandler("/info", s.infoHandler)
 	s.addHandler("/register", s.registrationHandler)
 	s.addHandler("/authenticate", s.authenticationHandler)
-	s.addAuthenticatedHandler("/exec", s.execHandler)
+	s.addAuthenticatedHandler("/exec", s.wrapCSRFHandler(s.execHandler))
+	s.addAuthenticatedHandler("/logout", s.wrapCSRFHandler(s.logoutHandler))
+	s.addHandler("/authenticate/totp", s.totpAuthenticationHandler)
+	s.addAuthenticatedHandler("/2fa/enroll", s.wrapCSRFHandler(s.totpEnrollHandler))
+	s.addAuthenticatedHandler("/2fa/confirm", s.wrapCSRFHandler(s.totpConfirmHandler))
+	s.addAuthenticatedHandler("/2fa/disable", s.wrapCSRFHandler(s.totpDisableHandler))
 	s.addAuthenticatedHandler("/query", s.queryHandler)
-	s.mux.Handle("/", http.FileServer(http.Dir("/app/public")))
+	s.addAuthenticatedHandler("/batch", s.batchHandler)
+	s.addAdminHandler("/admin/info", s.adminInfoHandler)
+	s.addAdminHandler("/admin/apikeys", s.listAPIKeysHandler)
+	s.addAdminHandler("/admin/apikeys/create", s.createAPIKeyHandler)
+	s.addAdminHandler("/admin/apikeys/revoke", s.revokeAPIKeyHandler)
+	s.addAdminHandler("/admin/ratelimits", s.rateLimitsHandler)
+	s.addAdminHandler("/admin/metrics", s.metricsHandler)
+	s.addAdminHandler("/admin/rejected", s.rejectedHandler)
+	s.mux.HandleFunc("/", s.serveStatic)
 	return s
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "log" {
+		if err := runLogCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	var cfg Config
 	if _, err := flags.ParseArgs(&cfg, os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
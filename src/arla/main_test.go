@@ -2,13 +2,18 @@ package main
 
 import (
 	"arla/schema"
+	"arla/totp"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -22,6 +27,12 @@ var (
 	kate  = NewUser("kate", "katington1")
 )
 
+// api key users are created by alice (who is an admin)
+var (
+	bobKey   = &User{}
+	otherKey = &User{}
+)
+
 func TestAPI(t *testing.T) {
 
 	// alice should already exist (created by loading the mutation log)
@@ -598,6 +609,174 @@ func TestAPI(t *testing.T) {
 
 	// -----------------------------
 
+	// persisted queries are run by id with the caller's session
+	alice.QueryID("myUsername").ShouldReturn(`{"me":{"username":"alice"}}`)
+	bob.QueryID("myUsername").ShouldReturn(`{"me":{"username":"bob"}}`)
+	bob.QueryID("countryCodes").ShouldReturn(`
+		{"countries": [{"code":"GB"}, {"code":"FR"}]}
+	`)
+	bob.QueryID("missing").ShouldFail()
+
+	// -----------------------------
+
+	// me is cached per session id so each user gets their own result
+	alice.Query(`me(){username}`).ShouldReturn(`{"me":{"username":"alice"}}`)
+	bob.Query(`me(){username}`).ShouldReturn(`{"me":{"username":"bob"}}`)
+	alice.Query(`me(){username}`).ShouldReturn(`{"me":{"username":"alice"}}`)
+
+	// the full app info is only available to admins
+	bob.Admin("/admin/info", nil).ShouldFail()
+	alice.Admin("/admin/info", nil).ShouldBeJSON()
+
+	// cache metrics are only available to admins
+	bob.Admin("/admin/metrics", nil).ShouldFail()
+	alice.Admin("/admin/metrics", nil).ShouldBeJSON()
+
+	// -----------------------------
+
+	// exec returns what the action declares
+	kate.Exec("setName", "Kate").ShouldSucceed().ShouldReturnResult(`{"name": "Kate"}`)
+	kate.Exec("addFriend", bob.ID.String()).ShouldSucceed().ShouldReturnResult(`null`)
+
+	// mutations from older clients are transformed but future versions and
+	// versions older than --min-api-version are rejected
+	kate.ExecVersion(1, "setName", "Kate").ShouldSucceed().ShouldReturnResult(`{"name": "Kate"}`)
+	kate.ExecVersion(3, "setName", "Kate").ShouldFail()
+	kate.ExecVersion(-1, "setName", "Kate").ShouldFail()
+
+	// the time seen by actions is pinned to when the mutation was received
+	kate.Exec("pinnedTime").ShouldSucceed().ShouldReturnResult(`{"pinned": true}`)
+
+	// failed mutations are recorded for admins to inspect
+	kate.Exec("addEmailAddress", schema.TimeUUID().String(), "kate-not-an-email").ShouldFail()
+	bob.Admin("/admin/rejected", map[string]interface{}{}).ShouldFail()
+	alice.Admin("/admin/rejected", map[string]interface{}{
+		"user":   kate.ID.String(),
+		"action": "addEmailAddress",
+	}).ShouldReturnCount("rejected", 1)
+	alice.Admin("/admin/rejected", map[string]interface{}{
+		"user":  kate.ID.String(),
+		"since": time.Now().Add(time.Hour),
+	}).ShouldReturnCount("rejected", 0)
+
+	// a dry run returns the result without changing anything
+	kate.DryRun("setName", "Katherine").ShouldSucceed().ShouldReturnResult(`{"name": "Katherine"}`)
+	kate.Query(`me(){name}`).ShouldReturn(`{"me":{"name":"Kate"}}`)
+	alice.DryRun("addEmailAddress", schema.TimeUUID().String(), "not-an-email").ShouldFail()
+
+	// a batch is applied all or nothing so the valid first mutation is
+	// rolled back when the second fails
+	alice.ExecBatch(
+		&schema.Mutation{Name: "addEmailAddress", Args: []interface{}{schema.TimeUUID().String(), "batch@alice.com"}},
+		&schema.Mutation{Name: "addEmailAddress", Args: []interface{}{schema.TimeUUID().String(), "not-an-email"}},
+	).ShouldFail()
+	alice.ExecBatch(
+		&schema.Mutation{Name: "addEmailAddress", Args: []interface{}{schema.TimeUUID().String(), "batch@alice.com"}},
+		&schema.Mutation{Name: "addEmailAddress", Args: []interface{}{schema.TimeUUID().String(), "batch2@alice.com"}},
+	).ShouldSucceed()
+	alice.ExecBatch(
+		&schema.Mutation{Name: "arla.revokeApiKey"},
+	).ShouldFail()
+
+	// exampleOp has a per-action rate limit of 1 per minute
+	bob.Exec("exampleOp", 1, 2, 3).ShouldSucceed()
+	bob.Exec("exampleOp", 1, 2, 3).ShouldFail()
+
+	// -----------------------------
+
+	// only admins can create api keys
+	bob.Admin("/admin/apikeys/create", map[string]interface{}{
+		"claims": map[string]interface{}{"id": bob.ID.String()},
+	}).ShouldFail()
+
+	// alice was granted superuser so she can create a key that acts as bob
+	// but can only exec addEmailAddress
+	alice.Admin("/admin/apikeys/create", map[string]interface{}{
+		"name":    "bob-integration",
+		"claims":  map[string]interface{}{"id": bob.ID.String()},
+		"actions": []string{"addEmailAddress"},
+	}).ShouldReturnAPIKey(bobKey)
+
+	// key should act with the fixed claims
+	bobKey.Query(`me(){username}`).ShouldReturn(`
+		{"me":{"username":"bob"}}
+	`)
+
+	// key should not be able to exec actions that were not allowed
+	bobKey.Exec("addFriend", kate.ID.String()).ShouldFail()
+
+	// key restricted to another address should not work from here
+	alice.Admin("/admin/apikeys/create", map[string]interface{}{
+		"claims": map[string]interface{}{"id": alice.ID.String()},
+		"ips":    []string{"10.1.2.3", "192.168.0.0/16"},
+	}).ShouldReturnAPIKey(otherKey)
+	otherKey.Query(`me(){username}`).ShouldFail()
+
+	// system mutations cannot be sent directly to exec
+	alice.Exec("arla.revokeApiKey").ShouldFail()
+
+	// revoked keys stop working
+	alice.Admin("/admin/apikeys/revoke", map[string]interface{}{
+		"id": &bobKey.KeyID,
+	}).ShouldSucceed()
+	bobKey.Query(`me(){username}`).ShouldFail()
+
+	// -----------------------------
+
+	// kate enrolls in two-factor authentication
+	kate.Admin("/2fa/enroll", nil).ShouldReturnTOTPEnrollment()
+
+	// enrollment should not be confirmed with a bad code
+	kate.Admin("/2fa/confirm", map[string]interface{}{
+		"enrollment_token": &kate.EnrollmentToken,
+		"code":             "xxxxxx",
+	}).ShouldFail()
+
+	// ...but should be with a code from her authenticator
+	kate.Admin("/2fa/confirm", map[string]interface{}{
+		"enrollment_token": &kate.EnrollmentToken,
+		"code":             totpCode{kate},
+	}).ShouldSucceed().ShouldReturnRecoveryCodes()
+
+	// logging in should now require a second step
+	kate.Authenticate().ShouldReturnChallenge()
+	kate.Admin("/authenticate/totp", map[string]interface{}{
+		"challenge_token": &kate.ChallengeToken,
+		"code":            "xxxxxx",
+	}).ShouldFail()
+	kate.Admin("/authenticate/totp", map[string]interface{}{
+		"challenge_token": &kate.ChallengeToken,
+		"code":            totpCode{kate},
+	}).After(totp.Period).ShouldBeAuthenticated()
+
+	// a code cannot be used twice
+	kate.Authenticate().ShouldReturnChallenge()
+	kate.Admin("/authenticate/totp", map[string]interface{}{
+		"challenge_token": &kate.ChallengeToken,
+		"code":            totpCode{kate},
+	}).ShouldFail()
+
+	// a recovery code can be used instead, but only once
+	kate.Authenticate().ShouldReturnChallenge()
+	kate.Admin("/authenticate/totp", map[string]interface{}{
+		"challenge_token": &kate.ChallengeToken,
+		"recovery_code":   recoveryCode{kate, 0},
+	}).ShouldBeAuthenticated()
+	kate.Authenticate().ShouldReturnChallenge()
+	kate.Admin("/authenticate/totp", map[string]interface{}{
+		"challenge_token": &kate.ChallengeToken,
+		"recovery_code":   recoveryCode{kate, 0},
+	}).ShouldFail()
+
+	// disabling 2fa requires a code
+	kate.Admin("/2fa/disable", nil).ShouldFail()
+	kate.Admin("/2fa/disable", map[string]interface{}{
+		"code": totpCode{kate},
+	}).After(totp.Period).ShouldSucceed()
+	kate.Authenticate().ShouldBeAuthenticated()
+
+	// -----------------------------
+
 	// alice should be indestructable
 	alice.Exec("destroyMember").ShouldFail()
 
@@ -643,8 +822,452 @@ func TestInfo(t *testing.T) {
 	if !found {
 		t.Fatal("expected registerMember to appear in the list of info.Mutations")
 	}
+	// the rest of the app config is only for admins
+	if info.RateLimits != nil || info.Cache != nil || info.Timeouts != nil || info.Queries != nil {
+		t.Fatalf("expected /info to only return the version and mutations got %s", b)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	preflight := func(origin string) *http.Response {
+		r, err := http.NewRequest("OPTIONS", "http://localhost/query", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Origin", origin)
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	res := preflight("https://app.example.com")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected allowed origin preflight to return 200 got %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Fatalf("expected Access-Control-Allow-Origin to echo origin got %q", got)
+	}
+	res = preflight("https://evil.com")
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected disallowed origin preflight to return 403 got %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("expected no Access-Control-Allow-Origin header got %q", got)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	res, err := http.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("X-Frame-Options"); got != "DENY" {
+		t.Fatalf("expected X-Frame-Options=DENY got %q", got)
+	}
+	if got := res.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Fatalf("expected X-Content-Type-Options=nosniff got %q", got)
+	}
+}
+
+func TestQueryETag(t *testing.T) {
+	u := NewUser("etag", "etagpassword")
+	register := &TestCase{URL: "/register", User: u, Data: u}
+	if err := register.ShouldBeAuthenticated().Test(); err != nil {
+		t.Fatal(err)
+	}
+	query := func(etag string) *http.Response {
+		body := strings.NewReader(`{"query": "me(){username}"}`)
+		r, err := http.NewRequest("POST", "http://localhost/query", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "bearer "+u.Token)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	res := query("")
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("expected query to return 200 with an ETag got %d %q", res.StatusCode, etag)
+	}
+	if res := query(etag); res.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected unchanged query to return 304 got %d", res.StatusCode)
+	}
+	// any committed mutation changes the log position
+	exec := &TestCase{
+		URL:  "/exec",
+		User: u,
+		Data: &schema.Mutation{
+			Name: "addEmailAddress",
+			Args: []interface{}{schema.TimeUUID().String(), "etag@example.com"},
+		},
+	}
+	if err := exec.ShouldSucceed().Test(); err != nil {
+		t.Fatal(err)
+	}
+	res = query(etag)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected query to be re-run after a mutation got %d", res.StatusCode)
+	}
+	if res.Header.Get("ETag") == etag {
+		t.Fatal("expected ETag to change after a mutation")
+	}
 }
 
+func TestQueryTimeout(t *testing.T) {
+	body := strings.NewReader(`{"query": "slow"}`)
+	r, err := http.NewRequest("POST", "http://localhost/query", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "bearer "+alice.Token)
+	start := time.Now()
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected slow query to be cancelled")
+	}
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected slow query to return 504 got %d", res.StatusCode)
+	}
+	var e struct {
+		Property string `json:"property"`
+		Timeout  int    `json:"timeout_ms"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Property != "slow" || e.Timeout != 100 {
+		t.Fatalf("expected error to name the slow property and its timeout got %+v", e)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	body := strings.NewReader(`[
+		{"query": "me(){username}"},
+		{"id": "countryCodes"},
+		{"query": "nonsense(){"},
+		{"query": "countries(){code}"},
+		{"id": "missing", "query": "me(){username}"}
+	]`)
+	r, err := http.NewRequest("POST", "http://localhost/batch", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "bearer "+alice.Token)
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected batch to return 200 got %d", res.StatusCode)
+	}
+	var items []map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`{"data": {"me": {"username": "alice"}}}`,
+		`{"data": {"countries": [{"code": "GB"}, {"code": "FR"}]}}`,
+		``,
+		`{"data": {"countries": [{"code": "GB"}, {"code": "FR"}]}}`,
+		``,
+	}
+	if len(items) != len(expected) {
+		t.Fatalf("expected %d results got %d", len(expected), len(items))
+	}
+	for i, item := range items {
+		if expected[i] == "" {
+			if _, ok := item["error"]; !ok {
+				t.Fatalf("expected batch item %d to fail got %v", i, item)
+			}
+			continue
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(expected[i]), &e); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(item, e) {
+			t.Fatalf("expected batch item %d to be %s got %v", i, expected[i], item)
+		}
+	}
+}
+
+func TestRequestMeta(t *testing.T) {
+	body := strings.NewReader(`{"name": "echoRequest"}`)
+	r, err := http.NewRequest("POST", "http://localhost/exec", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "bearer "+alice.Token)
+	r.Header.Set(RequestIDHeader, "test-request-1")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected exec to return 200 got %d", res.StatusCode)
+	}
+	if id := res.Header.Get(RequestIDHeader); id != "test-request-1" {
+		t.Fatalf("expected request id to be returned got %q", id)
+	}
+	var e struct {
+		Result struct {
+			RequestID string `json:"requestId"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Result.RequestID != "test-request-1" {
+		t.Fatalf("expected action to see the request id got %q", e.Result.RequestID)
+	}
+}
+
+func TestCookieSession(t *testing.T) {
+	post := func(url, body string, cookies []*http.Cookie, csrf string) *http.Response {
+		r, err := http.NewRequest("POST", "http://localhost"+url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", ApplicationJSON)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		if csrf != "" {
+			r.Header.Set(CSRFHeader, csrf)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	creds, err := json.Marshal(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clients that do not ask for a cookie still get the token
+	res := post("/authenticate", string(creds), nil, "")
+	var login struct {
+		AccessToken string `json:"access_token"`
+		CSRFToken   string `json:"csrf_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if login.AccessToken == "" || len(res.Cookies()) != 0 {
+		t.Fatalf("expected an access token and no cookies got %+v %v", login, res.Cookies())
+	}
+	// browser apps can ask for an HttpOnly cookie instead
+	res = post("/authenticate?session=cookie", string(creds), nil, "")
+	login.AccessToken = ""
+	if err := json.NewDecoder(res.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || login.AccessToken != "" || login.CSRFToken == "" {
+		t.Fatalf("expected a csrf token and no access token got %d %+v", res.StatusCode, login)
+	}
+	cookies := res.Cookies()
+	var session *http.Cookie
+	for _, c := range cookies {
+		if c.Name == "arla_session" {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("expected an HttpOnly session cookie got %v", cookies)
+	}
+	// state changes need the csrf header to match the cookie
+	exec := `{"name": "echoRequest"}`
+	if res := post("/exec", exec, cookies, ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected exec without csrf token to return 403 got %d", res.StatusCode)
+	}
+	if res := post("/exec", exec, cookies, "not-the-token"); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected exec with wrong csrf token to return 403 got %d", res.StatusCode)
+	}
+	if res := post("/exec", exec, cookies, login.CSRFToken); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected exec with csrf token to return 200 got %d", res.StatusCode)
+	}
+	// logging out expires both cookies
+	res = post("/logout", "{}", cookies, login.CSRFToken)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected logout to return 200 got %d", res.StatusCode)
+	}
+	expired := 0
+	for _, c := range res.Cookies() {
+		if (c.Name == "arla_session" || c.Name == "arla_csrf") && c.MaxAge < 0 {
+			expired++
+		}
+	}
+	if expired != 2 {
+		t.Fatalf("expected logout to expire both cookies got %v", res.Cookies())
+	}
+}
+
+func TestSpoofedRequestMeta(t *testing.T) {
+	body := strings.NewReader(`{"name": "echoRequest", "status": "rejected", "meta": {"requestId": "spoofed", "ip": "10.0.0.1"}}`)
+	r, err := http.NewRequest("POST", "http://localhost/exec", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "bearer "+alice.Token)
+	// ids that could break out of a quoted string are replaced
+	r.Header.Set(RequestIDHeader, "id');--")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected exec to return 200 got %d", res.StatusCode)
+	}
+	var e struct {
+		Result struct {
+			RequestID string `json:"requestId"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	id := res.Header.Get(RequestIDHeader)
+	if id == "id');--" {
+		t.Fatal("expected an invalid request id to be replaced")
+	}
+	if e.Result.RequestID != id {
+		t.Fatalf("expected the server's request id %q to be logged got %q", id, e.Result.RequestID)
+	}
+}
+
+func TestSpoofedPinnedValues(t *testing.T) {
+	body := strings.NewReader(`{"name": "pinnedValues", "meta": {"received": "2000-01-01T00:00:00Z", "seed": 1}}`)
+	r, err := http.NewRequest("POST", "http://localhost/exec", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "bearer "+alice.Token)
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected exec to return 200 got %d", res.StatusCode)
+	}
+	var e struct {
+		Result struct {
+			Now  time.Time `json:"now"`
+			Seed string    `json:"seed"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(e.Result.Now) > time.Minute {
+		t.Fatalf("expected the time to be pinned by the server got %v", e.Result.Now)
+	}
+	if len(e.Result.Seed) != 32 {
+		t.Fatalf("expected a 128 bit seed chosen by the server got %q", e.Result.Seed)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	s := New(Config{})
+	if s.cfg.AdminClaim != "admin" {
+		t.Fatalf("expected admin claim to default to admin got %q", s.cfg.AdminClaim)
+	}
+	if s.cfg.UserClaim != "id" {
+		t.Fatalf("expected user claim to default to id got %q", s.cfg.UserClaim)
+	}
+	if s.cfg.CookieName != "arla_session" {
+		t.Fatalf("expected cookie name to default to arla_session got %q", s.cfg.CookieName)
+	}
+}
+
+func TestStatic(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://localhost/members/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept", "text/html")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected deep link to serve index.html got %d", res.StatusCode)
+	}
+	if !strings.Contains(string(b), `window.ARLA_CONFIG = {"apiVersion":2}`) {
+		t.Fatalf("expected api version to be injected into index.html got %s", b)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", unixSocket)
+			},
+		},
+	}
+	res, err := client.Get("http://unix/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected /info over unix socket to return 200 got %d", res.StatusCode)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	s := New(Config{ListenAddr: []string{"unix:/run/arla.sock", ":8443"}})
+	for _, tc := range []struct {
+		method string
+		code   int
+	}{
+		{"GET", http.StatusMovedPermanently},
+		{"POST", http.StatusPermanentRedirect},
+	} {
+		r := httptest.NewRequest(tc.method, "http://example.com/query?x=1", nil)
+		w := httptest.NewRecorder()
+		s.redirectHandler(w, r)
+		if w.Code != tc.code {
+			t.Fatalf("expected %s redirect to return %d got %d", tc.method, tc.code, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != "https://example.com:8443/query?x=1" {
+			t.Fatalf("unexpected redirect location %s", loc)
+		}
+	}
+}
+
+// unixSocket is the path of the test server's unix socket listener
+var unixSocket string
+
 func TestMain(m *testing.M) {
 	// create a tmp dir
 	tmp, err := ioutil.TempDir("", "arlatestdata")
@@ -664,18 +1287,62 @@ func TestMain(m *testing.M) {
 		Args:    []interface{}{alice.ID, alice.Username, alice.Password},
 		Version: 1,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// make alice an admin
+	err = json.NewEncoder(f).Encode(&schema.Mutation{
+		Name:    "grantSuperUser",
+		Args:    []interface{}{alice.ID},
+		Token:   schema.Token{"admin": true},
+		Version: 2,
+	})
 	f.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
+	// write a client app
+	public := filepath.Join(tmp, "public")
+	if err := os.Mkdir(public, 0755); err != nil {
+		log.Fatal(err)
+	}
+	index := "<html><head></head><body>app</body></html>"
+	if err := ioutil.WriteFile(filepath.Join(public, "index.html"), []byte(index), 0644); err != nil {
+		log.Fatal(err)
+	}
+	// persisted queries can also be loaded from a directory
+	queries := filepath.Join(tmp, "queries")
+	if err := os.MkdirAll(queries, 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(queries, "countryCodes.aql"), []byte("countries(){code}"), 0644); err != nil {
+		log.Fatal(err)
+	}
 	// start server
+	unixSocket = filepath.Join(tmp, "arla.sock")
 	server := New(Config{
-		ConfigPath:     "config.js",
-		DataDir:        tmp,
-		Secret:         "mysecret",
-		Debug:          true,
-		MaxConnections: 5,
+		ConfigPath:          "config.js",
+		DataDir:             tmp,
+		Secret:              "mysecret",
+		Debug:               true,
+		MaxConnections:      5,
+		AuthConnections:     2,
+		QueueSize:           10,
+		QueueTimeout:        2000,
+		QueryTimeout:        10000,
+		QueryCacheSize:      1 << 20,
+		PersistedQueriesDir: queries,
+		ListenAddr:          []string{":80", "unix:" + unixSocket},
+		CORSOrigins:         []string{"https://*.example.com"},
+		FrameOptions:        "DENY",
+		PublicDir:           public,
+		SPAFallback:         true,
+		InjectConfig:        true,
+		CheckpointInterval:  10,
+		CookieSessions:      true,
+		CookieInsecure:      true,
 	})
+	server.now = testClock.Now
 	if err := server.Start(); err != nil {
 		log.Fatal("failed to start server", err)
 	}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"arla/schema"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader identifies a request. Clients may set it to tie their own
+// logs to the mutations they submit, otherwise the server assigns one. It
+// is always returned in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the size of client supplied request ids
+const maxRequestIDLength = 128
+
+type requestMetaContextKey struct{}
+
+// withRequestMeta returns r carrying the request details that are logged
+// with any mutation it submits and sets the request id response header
+func withRequestMeta(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = schema.TimeUUID().String()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	meta := &schema.Meta{
+		RequestID: id,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestMetaContextKey{}, meta))
+}
+
+// validRequestID returns true for non-empty ids of a reasonable length made
+// of letters, digits, dots, underscores and dashes
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.' || c == '_' || c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// addMeta gives m the metadata envelope of the request that ctx belongs
+// to, replacing any it already has. The time and seed are always assigned
+// here so that clients cannot choose the values actions see.
+func (s *Server) addMeta(ctx context.Context, m *schema.Mutation) {
+	m.Meta = &schema.Meta{}
+	if meta, ok := ctx.Value(requestMetaContextKey{}).(*schema.Meta); ok {
+		*m.Meta = *meta
+	}
+	// the time is pinned while executing in javascript which only has
+	// millisecond precision
+	m.Meta.Received = time.Now().UTC().Truncate(time.Millisecond)
+	m.Meta.Seed = randomSeed()
+	m.Meta.Version = m.Version
+	if m.Meta.Version == 0 && s.info != nil {
+		m.Meta.Version = s.info.Version
+	}
+}
+
+// randomSeed returns 128 random bits as a hex json string to seed the
+// random values of a mutation
+func randomSeed() json.RawMessage {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("failed to read random seed: %v", err))
+	}
+	return json.RawMessage(`"` + hex.EncodeToString(b[:]) + `"`)
+}
@@ -0,0 +1,221 @@
+package mutationstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// headerMagic starts the header line of segment files. Segments without a
+// header were written before codecs existed and are NDJSON.
+const headerMagic = "arla-log "
+
+// headerVersion is the format of the segment header
+const headerVersion = 1
+
+// Codec encodes the JSON records of a segment file
+type Codec interface {
+	// Name identifies the codec in segment headers
+	Name() string
+	// NewEncoder returns an Encoder that writes records to w
+	NewEncoder(w io.Writer) Encoder
+	// NewDecoder returns a Decoder that reads records from r
+	NewDecoder(r io.Reader) (Decoder, error)
+	// Appendable codecs can add records to a segment written by an
+	// earlier Encoder. Segments of other codecs are sealed on restart.
+	Appendable() bool
+}
+
+// Encoder writes records
+type Encoder interface {
+	// Encode writes the JSON record b, which must not contain newlines
+	Encode(b []byte) error
+	// Flush writes buffered records so that they can be decoded once the
+	// underlying file is synced
+	Flush() error
+	// Close flushes and ends the encoding. It does not close the writer.
+	Close() error
+}
+
+// Decoder reads records
+type Decoder interface {
+	// Next returns the next JSON record. It returns io.EOF after the last
+	// record and io.ErrUnexpectedEOF if the last record is incomplete.
+	Next() ([]byte, error)
+}
+
+// NDJSON writes one JSON record per line
+var NDJSON Codec = ndjsonCodec{}
+
+// Gzip writes NDJSON through one gzip stream per segment that is flushed
+// after each record. Repeated fields like the token and name compress to
+// back-references to earlier records.
+var Gzip Codec = gzipCodec{}
+
+// codecs are the codecs that can be named in a segment header
+var codecs = map[string]Codec{
+	NDJSON.Name(): NDJSON,
+	Gzip.Name():   Gzip,
+}
+
+// CodecByName returns the codec called name
+func CodecByName(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown log codec %q (expected one of %s)", name, strings.Join(CodecNames(), ", "))
+	}
+	return c, nil
+}
+
+// CodecNames returns the names of the available codecs
+func CodecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeHeader writes the segment header identifying c to w
+func writeHeader(w io.Writer, c Codec) error {
+	_, err := fmt.Fprintf(w, "%s%d %s\n", headerMagic, headerVersion, c.Name())
+	return err
+}
+
+// readHeader reads the segment header from r and returns the codec it
+// names, or NDJSON if there is no header
+func readHeader(r *bufio.Reader) (Codec, error) {
+	magic, err := r.Peek(len(headerMagic))
+	if err == io.EOF || (err == nil && string(magic) != headerMagic) {
+		return NDJSON, nil
+	} else if err != nil {
+		return nil, err
+	}
+	line, err := r.ReadString('\n')
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, headerMagic))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid log segment header %q", strings.TrimSpace(line))
+	}
+	if v, err := strconv.Atoi(fields[0]); err != nil || v != headerVersion {
+		return nil, fmt.Errorf("unsupported log segment version %s", fields[0])
+	}
+	return CodecByName(fields[1])
+}
+
+// newSegmentDecoder reads the header of a segment and returns a decoder
+// for its records
+func newSegmentDecoder(r io.Reader) (Codec, Decoder, error) {
+	br := bufio.NewReader(r)
+	c, err := readHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec, err := c.NewDecoder(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, dec, nil
+}
+
+type ndjsonCodec struct{}
+
+func (ndjsonCodec) Name() string     { return "ndjson" }
+func (ndjsonCodec) Appendable() bool { return true }
+
+func (ndjsonCodec) NewEncoder(w io.Writer) Encoder {
+	return &lineEncoder{w: w}
+}
+
+func (ndjsonCodec) NewDecoder(r io.Reader) (Decoder, error) {
+	return newLineDecoder(r), nil
+}
+
+// lineEncoder writes each record on its own line
+type lineEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *lineEncoder) Encode(b []byte) error {
+	e.buf = append(append(e.buf[:0], b...), '\n')
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (e *lineEncoder) Flush() error { return nil }
+func (e *lineEncoder) Close() error { return nil }
+
+// lineDecoder reads records from lines, skipping blank ones
+type lineDecoder struct {
+	r *bufio.Reader
+}
+
+func newLineDecoder(r io.Reader) *lineDecoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &lineDecoder{r: br}
+	}
+	return &lineDecoder{r: bufio.NewReader(r)}
+}
+
+func (d *lineDecoder) Next() ([]byte, error) {
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a stream that ends between records was cut short by a
+			// crash after the last complete record was synced
+			if len(bytes.TrimSpace(line)) == 0 {
+				return nil, io.EOF
+			}
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string     { return "gzip" }
+func (gzipCodec) Appendable() bool { return false }
+
+func (gzipCodec) NewEncoder(w io.Writer) Encoder {
+	z := gzip.NewWriter(w)
+	return &gzipEncoder{z: z, lines: lineEncoder{w: z}}
+}
+
+func (gzipCodec) NewDecoder(r io.Reader) (Decoder, error) {
+	z, err := gzip.NewReader(r)
+	if err == io.EOF {
+		// nothing has been written after the header
+		return newLineDecoder(bytes.NewReader(nil)), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return newLineDecoder(z), nil
+}
+
+// gzipEncoder writes lines to a gzip stream
+type gzipEncoder struct {
+	z     *gzip.Writer
+	lines lineEncoder
+}
+
+func (e *gzipEncoder) Encode(b []byte) error { return e.lines.Encode(b) }
+
+func (e *gzipEncoder) Flush() error { return e.z.Flush() }
+func (e *gzipEncoder) Close() error { return e.z.Close() }
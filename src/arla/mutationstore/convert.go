@@ -0,0 +1,94 @@
+package mutationstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Convert rewrites every segment of the log at path with the codec c,
+// including archived segments which are brought back into the log
+// directory. The new log is written alongside and swapped in once it is
+// complete, the original is kept at path+".old". The log must not be open.
+// It returns the number of records converted.
+func Convert(path string, c Codec) (int64, error) {
+	old := path + ".old"
+	if _, err := os.Stat(old); err == nil {
+		return 0, fmt.Errorf("%s already exists, remove it before converting again", old)
+	}
+	src, err := OpenWith(path, Options{})
+	if err != nil {
+		return 0, err
+	}
+	segments := src.segments()
+	defer src.Close()
+	tmp := path + ".convert"
+	if err := os.RemoveAll(tmp); err != nil {
+		return 0, err
+	}
+	if err := os.Mkdir(tmp, 0770); err != nil {
+		return 0, err
+	}
+	m := &manifest{Version: manifestVersion}
+	var total int64
+	for _, seg := range segments {
+		converted, err := src.convertSegment(seg, filepath.Join(tmp, segmentName(seg.First)), c)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return total, fmt.Errorf("failed to convert segment %s: %s", seg.File, err)
+		}
+		if seg.Sealed && converted.Last != seg.Last {
+			os.RemoveAll(tmp)
+			return total, fmt.Errorf("segment %s has %d records but the manifest expects %d", seg.File, converted.Last-seg.First+1, seg.Last-seg.First+1)
+		}
+		total += converted.Last - converted.First + 1
+		m.Segments = append(m.Segments, converted)
+	}
+	if err := writeManifest(tmp, m); err != nil {
+		return total, err
+	}
+	if err := src.Close(); err != nil {
+		return total, err
+	}
+	if err := os.Rename(path, old); err != nil {
+		return total, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return total, err
+	}
+	return total, syncDir(filepath.Dir(path))
+}
+
+// convertSegment writes the records of seg to filename with the codec c
+func (l *Log) convertSegment(seg *Segment, filename string, c Codec) (*Segment, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := writeHeader(f, c); err != nil {
+		return nil, err
+	}
+	enc := c.NewEncoder(f)
+	converted := &Segment{
+		File:    filepath.Base(filename),
+		First:   seg.First,
+		Last:    seg.First - 1,
+		Created: seg.Created,
+		Sealed:  seg.Sealed,
+	}
+	err = l.scanSegment(seg, func(b []byte) error {
+		converted.Last++
+		return enc.Encode(b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return converted, f.Close()
+}
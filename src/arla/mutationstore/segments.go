@@ -0,0 +1,475 @@
+package mutationstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// manifestName is the file in the log directory listing its segments
+const manifestName = "manifest.json"
+
+// manifestVersion is the format of the manifest
+const manifestVersion = 1
+
+// Segment is one file of the log holding the mutations numbered First to
+// Last. An empty segment has a Last of First-1.
+type Segment struct {
+	// File is the name of the segment in the log directory, or its full
+	// path once it has been archived elsewhere
+	File    string    `json:"file"`
+	First   int64     `json:"first"`
+	Last    int64     `json:"last"`
+	Created time.Time `json:"created"`
+	// Sealed segments are no longer written to
+	Sealed     bool `json:"sealed,omitempty"`
+	Compressed bool `json:"compressed,omitempty"`
+	Archived   bool `json:"archived,omitempty"`
+}
+
+// manifest records the segments of the log in order. The Last of the
+// active segment is only brought up to date when it is sealed, it is
+// recounted when the log is opened.
+type manifest struct {
+	Version  int        `json:"version"`
+	Segments []*Segment `json:"segments"`
+}
+
+// segmentName is the file name of the segment starting at first
+func segmentName(first int64) string {
+	return fmt.Sprintf("%020d.log", first)
+}
+
+// readManifest loads the manifest from dir. If there is none a manifest
+// with a single empty segment is returned.
+func readManifest(dir string) (*manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return &manifest{
+			Version:  manifestVersion,
+			Segments: []*Segment{{File: segmentName(1), First: 1, Last: 0, Created: time.Now()}},
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid log manifest: %s", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported log manifest version %d", m.Version)
+	}
+	if len(m.Segments) == 0 {
+		return nil, fmt.Errorf("log manifest has no segments")
+	}
+	return &m, nil
+}
+
+// writeManifest replaces the manifest in dir so that a crash leaves
+// either the old or the new one in place
+func writeManifest(dir string, m *manifest) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, manifestName+".tmp")
+	if err := writeFileSync(tmp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, manifestName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeFileSync creates filename with the contents b and syncs it
+func writeFileSync(filename string, b []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes renames and new files in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// countRecords returns the number of complete records in the segment file
+// and its codec, creating the file if it does not exist. A partially
+// written last record is not counted.
+func countRecords(filename string) (int64, Codec, error) {
+	f, err := os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	c, dec, err := newSegmentDecoder(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	var n int64
+	for {
+		_, err := dec.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, c, nil
+		} else if err != nil {
+			return n, c, err
+		}
+		n++
+	}
+}
+
+// truncatePartial removes a partially written last record from an NDJSON
+// segment so that records appended to it start on a new line. A crash
+// while writing can leave such a record behind.
+func truncatePartial(filename string) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// find the end of the last complete line
+	end := fi.Size()
+	buf := make([]byte, 64<<10)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == fi.Size() {
+		return nil
+	}
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// migrate turns a log written as a single file at path into a directory of
+// segments with the old file as the first one. A migration interrupted by
+// a crash is finished or restarted.
+func migrate(path string) error {
+	tmp := path + ".migrate"
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// the old file was moved but the directory not yet renamed
+		if _, err := os.Stat(tmp); err == nil {
+			return os.Rename(tmp, path)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	n, _, err := countRecords(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(tmp, 0770); err != nil {
+		return err
+	}
+	m := &manifest{
+		Version:  manifestVersion,
+		Segments: []*Segment{{File: segmentName(1), First: 1, Last: n, Created: fi.ModTime()}},
+	}
+	if n > 0 {
+		// seal the old file so it can be archived
+		m.Segments[0].Sealed = true
+		active := &Segment{File: segmentName(n + 1), First: n + 1, Last: n, Created: time.Now()}
+		if err := writeFileSync(filepath.Join(tmp, active.File), nil); err != nil {
+			return err
+		}
+		m.Segments = append(m.Segments, active)
+	}
+	if err := writeManifest(tmp, m); err != nil {
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(tmp, m.Segments[0].File)); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// segmentPath is the full path of the segment file
+func (l *Log) segmentPath(s *Segment) string {
+	if filepath.IsAbs(s.File) {
+		return s.File
+	}
+	return filepath.Join(l.dir, s.File)
+}
+
+// Segments returns the segments of the log in order with File set to the
+// full path of each segment
+func (l *Log) Segments() []Segment {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments := make([]Segment, len(l.manifest.Segments))
+	for i, s := range l.manifest.Segments {
+		segments[i] = *s
+		segments[i].File = l.segmentPath(s)
+	}
+	return segments
+}
+
+// segments returns a copy of the manifest's segments for reading
+func (l *Log) segments() []*Segment {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments := make([]*Segment, len(l.manifest.Segments))
+	for i, s := range l.manifest.Segments {
+		c := *s
+		segments[i] = &c
+	}
+	return segments
+}
+
+// openSegment opens a segment for reading, decompressing it if it was
+// compressed by Archive. If the segment was archived since s was copied
+// from the manifest it is opened from its new location.
+func (l *Log) openSegment(s *Segment) (io.ReadCloser, error) {
+	f, err := os.Open(l.segmentPath(s))
+	if os.IsNotExist(err) {
+		for _, c := range l.segments() {
+			if c.First == s.First && c.File != s.File {
+				s = c
+				f, err = os.Open(l.segmentPath(s))
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.Compressed {
+		return f, nil
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: z, f: f}, nil
+}
+
+// decodeSegment opens a segment and returns a decoder for its records
+func (l *Log) decodeSegment(s *Segment) (Decoder, io.Closer, error) {
+	f, err := l.openSegment(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, dec, err := newSegmentDecoder(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("log segment %s: %s", s.File, err)
+	}
+	return dec, f, nil
+}
+
+// gzipFile closes both the gzip reader and its file
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// shouldRotate returns true if the active segment is due to be sealed.
+// Segments are only rotated when written to so an idle segment may be
+// older than SegmentAge.
+func (l *Log) shouldRotate(active *Segment, size int64) bool {
+	if active.Last < active.First {
+		return false
+	}
+	if l.opts.SegmentSize > 0 && size >= l.opts.SegmentSize {
+		return true
+	}
+	return l.opts.SegmentAge > 0 && time.Since(active.Created) >= l.opts.SegmentAge
+}
+
+// rotate seals the active segment and starts a new one, returning the file
+// to write to
+func (l *Log) rotate(f *os.File) (*os.File, error) {
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := l.manifest.Segments[len(l.manifest.Segments)-1]
+	active := &Segment{
+		File:    segmentName(prev.Last + 1),
+		First:   prev.Last + 1,
+		Last:    prev.Last,
+		Created: time.Now(),
+	}
+	f, err := os.OpenFile(l.segmentPath(active), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{Version: manifestVersion, Segments: append(l.manifest.Segments, active)}
+	prev.Sealed = true
+	if err := writeManifest(l.dir, m); err != nil {
+		prev.Sealed = false
+		f.Close()
+		return nil, err
+	}
+	l.manifest = m
+	return f, nil
+}
+
+// Archive moves the sealed segments that end at or before the mutation
+// numbered through to the ArchiveDir, compressing them if Compress is set.
+// Archived segments stay in the manifest so they are still replayed. It
+// returns the number of segments archived.
+func (l *Log) Archive(through int64) (int, error) {
+	if l.opts.ArchiveDir == "" && !l.opts.Compress {
+		return 0, nil
+	}
+	l.archiveMu.Lock()
+	defer l.archiveMu.Unlock()
+	n := 0
+	for _, s := range l.segments() {
+		if !s.Sealed || s.Archived || s.Last > through || s.Last < s.First {
+			continue
+		}
+		if err := l.archive(s); err != nil {
+			return n, fmt.Errorf("failed to archive segment %s: %s", s.File, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// archive copies the segment s to its archived location, updates the
+// manifest and then removes the original
+func (l *Log) archive(s *Segment) error {
+	src := l.segmentPath(s)
+	dir := l.dir
+	if l.opts.ArchiveDir != "" {
+		dir = l.opts.ArchiveDir
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return err
+		}
+	}
+	name := filepath.Base(s.File)
+	if l.opts.Compress && !s.Compressed {
+		name += ".gz"
+	}
+	dst := filepath.Join(dir, name)
+	if err := copySegment(src, dst, l.opts.Compress && !s.Compressed); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	var updated *Segment
+	for _, c := range l.manifest.Segments {
+		if c.First == s.First {
+			updated = c
+		}
+	}
+	prev := *updated
+	updated.Archived = true
+	updated.Compressed = updated.Compressed || l.opts.Compress
+	updated.File = name
+	if dir != l.dir {
+		updated.File = dst
+	}
+	err := writeManifest(l.dir, l.manifest)
+	if err != nil {
+		*updated = prev
+	}
+	l.mu.Unlock()
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copySegment copies the segment file src to dst, gzipping it if compress
+// is set. dst is only created once the copy is complete.
+func copySegment(src, dst string, compress bool) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+		}
+	}()
+	if compress {
+		z := gzip.NewWriter(out)
+		if _, err = io.Copy(z, in); err != nil {
+			return err
+		}
+		if err = z.Close(); err != nil {
+			return err
+		}
+	} else if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
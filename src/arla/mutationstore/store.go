@@ -1,64 +1,159 @@
 // Package mutationstore implements a channel based interface for reading/writing
 // a sequential log of Mutations to disk in a safe way.
+//
+// A log is a directory of segment files that are written to in turn and a
+// manifest recording which mutations each segment holds. Mutations are
+// numbered from 1 in the order they are written.
 package mutationstore
 
 import (
 	"arla/schema"
-	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultSegmentSize is the size in bytes at which segments are rotated by
+// logs opened with Open
+const DefaultSegmentSize = 64 << 20
+
+// Options control how the log is split into segments and archived
+type Options struct {
+	// SegmentSize is the size in bytes at which the active segment is
+	// sealed and a new one started (0 for no limit)
+	SegmentSize int64
+	// SegmentAge is how long a segment is written to before it is sealed
+	// (0 for no limit)
+	SegmentAge time.Duration
+	// ArchiveDir is where Archive moves sealed segments ("" leaves them in
+	// the log directory)
+	ArchiveDir string
+	// Compress makes Archive gzip the segments
+	Compress bool
+	// Codec encodes new segments (nil for NDJSON)
+	Codec Codec
+}
+
 // Log gives safe sequential access to the log of Mutations
 type Log struct {
-	filename string
-	in       chan (*writeRequest)
-	closed   bool
-	count    int64
+	dir    string
+	opts   Options
+	in     chan (*writeRequest)
+	closed bool
+	count  int64
+	// mu guards the manifest
+	mu        sync.Mutex
+	manifest  *manifest
+	archiveMu sync.Mutex
+	// sealActive is set if the active segment was written with a codec
+	// that cannot be continued
+	sealActive bool
+	// readOnly logs have no writer and never change the files
+	readOnly bool
+	done     chan struct{}
 	io.Reader
 }
 
 type writeRequest struct {
 	m   *schema.Mutation
+	pos int64
 	err chan (error)
 }
 
 // Write a mutation to the Log.
 func (l *Log) Write(m *schema.Mutation) error {
+	_, err := l.Append(m)
+	return err
+}
+
+// Append writes a mutation to the Log and returns its position, which is
+// the value of Len once the mutation has been synced.
+func (l *Log) Append(m *schema.Mutation) (int64, error) {
 	r := &writeRequest{
 		m:   m,
 		err: make(chan (error)),
 	}
 	if l.closed {
-		return fmt.Errorf("cannot write to closed log")
+		return 0, fmt.Errorf("cannot write to closed log")
+	}
+	if l.readOnly {
+		return 0, fmt.Errorf("cannot write to read only log")
 	}
 	l.in <- r
-	l.count++
-	return <-r.err
+	if err := <-r.err; err != nil {
+		return 0, err
+	}
+	return r.pos, nil
 }
 
-// Close the log
+// Close the log and wait for the active segment to be finished
 func (l *Log) Close() error {
 	if l.closed {
 		return nil
 	}
 	l.closed = true
+	if l.readOnly {
+		return nil
+	}
 	close(l.in)
+	<-l.done
 	return nil
 }
 
+// countingWriter counts the bytes written to the active segment
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
 // writer is a goroutine that reads from the "in" chan
 // and writes the value to disk
 func (l *Log) writer() {
+	defer close(l.done)
+	l.mu.Lock()
+	active := l.manifest.Segments[len(l.manifest.Segments)-1]
+	l.mu.Unlock()
 	// Open as O_RDWR (which should get lock) and O_DIRECT.
-	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND, 0660)
+	f, err := os.OpenFile(l.segmentPath(active), os.O_WRONLY|os.O_APPEND, 0660)
 	if err != nil {
 		panic(err)
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
+	fi, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+	w := &countingWriter{w: f, n: fi.Size()}
+	var enc Encoder
+	defer func() {
+		if enc != nil && enc.Close() == nil {
+			f.Sync()
+		}
+		f.Close()
+	}()
+	// start begins encoding to the active segment, writing the header if
+	// it is new
+	start := func() error {
+		if w.n == 0 {
+			if err := writeHeader(w, l.codec()); err != nil {
+				return err
+			}
+		}
+		enc = l.codec().NewEncoder(w)
+		return nil
+	}
 	for {
 		r, ok := <-l.in
 		if !ok {
@@ -68,16 +163,69 @@ func (l *Log) writer() {
 			r.err <- fmt.Errorf("cannot write nil to wal")
 			return
 		}
+		// start a new segment if the active one is full or cannot be
+		// continued with this log's codec
+		l.mu.Lock()
+		rotate := l.shouldRotate(active, w.n) || (enc == nil && l.sealActive && active.Last >= active.First)
+		l.mu.Unlock()
+		if rotate {
+			if enc != nil {
+				if err := enc.Close(); err != nil {
+					r.err <- fmt.Errorf("wal encoding: %s", err.Error())
+					return
+				}
+				enc = nil
+			}
+			if f, err = l.rotate(f); err != nil {
+				r.err <- fmt.Errorf("wal rotate: %s", err.Error())
+				return
+			}
+			l.mu.Lock()
+			active = l.manifest.Segments[len(l.manifest.Segments)-1]
+			l.mu.Unlock()
+			w = &countingWriter{w: f}
+		} else if enc == nil && l.sealActive {
+			// nothing but the header of another codec has been written
+			if err := f.Truncate(0); err != nil {
+				r.err <- fmt.Errorf("wal truncate: %s", err.Error())
+				return
+			}
+			w.n = 0
+		}
+		if enc == nil {
+			if err := start(); err != nil {
+				r.err <- fmt.Errorf("wal header: %s", err.Error())
+				return
+			}
+		}
+		// number the mutation with its position in the log
+		seq := atomic.LoadInt64(&l.count) + 1
+		if r.m.Meta != nil {
+			r.m.Meta.Seq = seq
+		}
 		// serialize mutation and write to disk
-		if err := enc.Encode(r.m); err != nil {
+		b, err := json.Marshal(r.m)
+		if err != nil {
 			r.err <- fmt.Errorf("wal encoding: %s", err.Error())
 			return
 		}
+		if err := enc.Encode(b); err != nil {
+			r.err <- fmt.Errorf("wal write: %s", err.Error())
+			return
+		}
+		if err := enc.Flush(); err != nil {
+			r.err <- fmt.Errorf("wal write: %s", err.Error())
+			return
+		}
 		// sync
 		if err := f.Sync(); err != nil {
 			r.err <- fmt.Errorf("wal sync: %s", err.Error())
 			return
 		}
+		l.mu.Lock()
+		active.Last = seq
+		l.mu.Unlock()
+		r.pos = atomic.AddInt64(&l.count, 1)
 		r.err <- nil
 		// send to reader
 		if l.closed {
@@ -86,91 +234,203 @@ func (l *Log) writer() {
 	}
 }
 
+// codec returns the codec new segments are written with
+func (l *Log) codec() Codec {
+	if l.opts.Codec == nil {
+		return NDJSON
+	}
+	return l.opts.Codec
+}
+
 // Replay returns a channel that emits each item from the log.
 func (l *Log) Replay() <-chan (*schema.Mutation) {
 	ch := make(chan (*schema.Mutation), 1000)
 	go func() {
-		f, err := os.OpenFile(l.filename, os.O_RDONLY, 0660)
-		if err != nil {
-			panic(err)
-		}
-		defer f.Close()
-		dec := json.NewDecoder(f)
-		for {
-			var m schema.Mutation
-			if err := dec.Decode(&m); err == io.EOF {
-				break
-			} else if err != nil {
+		for _, seg := range l.segments() {
+			dec, f, err := l.decodeSegment(seg)
+			if err != nil {
 				panic(err)
 			}
-			ch <- &m
+			for {
+				b, err := dec.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					panic(err)
+				}
+				var m schema.Mutation
+				if err := json.Unmarshal(b, &m); err != nil {
+					panic(err)
+				}
+				ch <- &m
+			}
+			f.Close()
 		}
 		close(ch)
 	}()
 	return ch
 }
 
-// WriteTo writes the log as SQL statements to w
-func (l *Log) WriteTo(w io.Writer) (n int64, err error) {
-	f, err := os.OpenFile(l.filename, os.O_RDONLY, 0660)
+// Scan calls fn with each mutation in the log in order until fn returns
+// false. Unlike Replay it returns errors rather than panicking and stops at
+// a partially written last record, so it can be used while the log is being
+// written to.
+func (l *Log) Scan(fn func(*schema.Mutation) bool) error {
+	return l.scanRecords(func(b []byte) error {
+		var m schema.Mutation
+		if err := json.Unmarshal(b, &m); err != nil {
+			return err
+		}
+		if !fn(&m) {
+			return errStop
+		}
+		return nil
+	})
+}
+
+// errStop ends a scan early
+var errStop = errors.New("stop scan")
+
+// scanRecords calls fn with each JSON record in the log until fn returns an
+// error, which is returned unless it is errStop
+func (l *Log) scanRecords(fn func([]byte) error) error {
+	for _, seg := range l.segments() {
+		err := l.scanSegment(seg, fn)
+		if err == errStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanSegment calls fn with each record in seg
+func (l *Log) scanSegment(seg *Segment, fn func([]byte) error) error {
+	dec, f, err := l.decodeSegment(seg)
 	if err != nil {
-		return
+		return err
 	}
 	defer f.Close()
-	prefix := "select arla_replay('"
-	suffix := "'::json);\n"
-	s := bufio.NewScanner(f)
-	nx := 0
-	for s.Scan() {
-		b := s.Bytes()
-		// skip blank lines
-		if len(b) == 0 {
-			continue
-		}
-		// write prefix
-		if nx, err = w.Write([]byte(prefix)); err != nil {
-			return
-		}
-		n += int64(nx)
-		// write line
-		if nx, err = w.Write(b); err != nil {
-			return
+	for {
+		b, err := dec.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
 		}
-		n += int64(nx)
-		// write suffix
-		if nx, err = w.Write([]byte(suffix)); err != nil {
-			return
+		if err := fn(b); err != nil {
+			return err
 		}
-		n += int64(nx)
-		l.count++
-	}
-	if err = s.Err(); err != nil {
-		return
 	}
+}
+
+// WriteTo writes the log as SQL statements to w. Quotes in the records are
+// doubled so that each one stays inside its string literal.
+func (l *Log) WriteTo(w io.Writer) (n int64, err error) {
+	prefix := []byte("select arla_replay('")
+	suffix := []byte("'::json);\n")
+	err = l.scanRecords(func(b []byte) error {
+		b = bytes.Replace(b, []byte("'"), []byte("''"), -1)
+		for _, part := range [][]byte{prefix, b, suffix} {
+			nx, err := w.Write(part)
+			n += int64(nx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	return
 }
 
-// Len returns the current number of mutations logged
+// Len returns the current number of mutations logged. It only increases
+// once a write has been synced so it can be used as the log position.
 func (l *Log) Len() int64 {
-	return l.count
+	return atomic.LoadInt64(&l.count)
 }
 
-// Open sets up access to a Log for a given filename.
-// If filename does not exist, it will be created.
-// If a replay channel is returned, then each mutation read from disk
-// will be sent to the chan. The chan will be closed once all mutations are read
-// Writes will be buffered until all mutations are sent to the chan - so you MUST
-// drain this chan before issusing writes!
+// Open sets up access to a Log at the given path with segments of
+// DefaultSegmentSize. See OpenWith.
 func Open(filename string) (l *Log, err error) {
+	return OpenWith(filename, Options{SegmentSize: DefaultSegmentSize})
+}
+
+// OpenWith sets up access to the Log in the directory at path.
+// If path does not exist, it will be created. If path is a log written as a
+// single file it is migrated to a directory of segments.
+func OpenWith(path string, opts Options) (l *Log, err error) {
+	if err := migrate(path); err != nil {
+		return nil, fmt.Errorf("failed to migrate log %s: %s", path, err)
+	}
+	if err := os.MkdirAll(path, 0770); err != nil {
+		return nil, err
+	}
+	if opts.ArchiveDir != "" {
+		if opts.ArchiveDir, err = filepath.Abs(opts.ArchiveDir); err != nil {
+			return nil, err
+		}
+	}
+	m, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
 	l = &Log{
-		filename: filename,
+		dir:      path,
+		opts:     opts,
+		manifest: m,
 		in:       make(chan (*writeRequest), 1000),
+		done:     make(chan struct{}),
 	}
-	f, err := os.OpenFile(l.filename, os.O_RDONLY|os.O_CREATE, 0660)
+	// the manifest is only updated when a segment is sealed so count what
+	// has been written to the active segment since
+	active := m.Segments[len(m.Segments)-1]
+	n, c, err := countRecords(l.segmentPath(active))
 	if err != nil {
-		return l, err
+		return nil, err
+	}
+	// compressed segments are never appended to after a restart so only
+	// NDJSON needs a partial record removing
+	if c == NDJSON {
+		if err := truncatePartial(l.segmentPath(active)); err != nil {
+			return nil, err
+		}
+	}
+	l.sealActive = c != l.codec() || !c.Appendable()
+	active.Last = active.First + n - 1
+	l.count = active.Last
+	if _, err := os.Stat(filepath.Join(path, manifestName)); os.IsNotExist(err) {
+		if err := writeManifest(path, m); err != nil {
+			return nil, err
+		}
 	}
-	defer f.Close()
 	go l.writer()
 	return l, nil
 }
+
+// OpenReadOnly gives access to the Log at path for reading without changing
+// anything on disk, so it is safe to use while a server is writing to the
+// log. A log written as a single file is read as one segment rather than
+// being migrated. Len is not known and Append fails.
+func OpenReadOnly(path string) (*Log, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: path, readOnly: true}
+	if !fi.IsDir() {
+		l.dir = filepath.Dir(path)
+		l.manifest = &manifest{
+			Version:  manifestVersion,
+			Segments: []*Segment{{File: filepath.Base(path), First: 1, Created: fi.ModTime()}},
+		}
+		return l, nil
+	}
+	if _, err := os.Stat(filepath.Join(path, manifestName)); err != nil {
+		return nil, fmt.Errorf("log %s has no manifest: %s", path, err)
+	}
+	if l.manifest, err = readManifest(path); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -2,10 +2,12 @@ package mutationstore
 
 import (
 	"arla/schema"
+	"bytes"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -52,51 +54,457 @@ func TestWriteThenRead(t *testing.T) {
 	}
 }
 
-func BenchmarkWrites(b *testing.B) {
-	m := &schema.Mutation{
-		ID:   schema.TimeUUID(),
-		Name: "exampleOp",
+func TestAppendPosition(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestAppendPosition")
+	log, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
 	}
-	// remove file if exists
-	filename := filepath.Join(tmpdir, "BenchmarkWrites")
-	os.Remove(filename)
-	// open
+	defer log.Close()
+	for i := int64(1); i <= 3; i++ {
+		m := &schema.Mutation{Name: "exampleOp", Meta: &schema.Meta{}}
+		pos, err := log.Append(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != i || log.Len() != i {
+			t.Fatalf("expected position %d got %d (len %d)", i, pos, log.Len())
+		}
+		if m.Meta.Seq != pos {
+			t.Fatalf("expected seq %d got %d", pos, m.Meta.Seq)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestScan")
 	log, err := Open(filename)
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
-	b.ResetTimer()
-	// write alot
-	for i := 0; i < b.N; i++ {
-		if err := log.Write(m); err != nil {
-			b.Fatal(err)
+	defer log.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := log.Write(&schema.Mutation{Name: name}); err != nil {
+			t.Fatal(err)
 		}
 	}
+	// simulate a record that is still being written
+	segments := log.Segments()
+	f, err := os.OpenFile(segments[len(segments)-1].File, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"name":"d`)
+	f.Close()
+	var names []string
+	err = log.Scan(func(m *schema.Mutation) bool {
+		names = append(names, m.Name)
+		return len(names) < 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Fatalf("expected scan to stop after a and b got %v", names)
+	}
+	names = nil
+	if err := log.Scan(func(m *schema.Mutation) bool {
+		names = append(names, m.Name)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Fatalf("expected partial record to be skipped got %v", names)
+	}
 }
 
-func BenchmarkReads(b *testing.B) {
-	m := &schema.Mutation{
-		ID:   schema.TimeUUID(),
-		Name: "exampleOp",
+// names returns the names of the mutations in the log
+func names(t *testing.T, log *Log) []string {
+	var names []string
+	if err := log.Scan(func(m *schema.Mutation) bool {
+		names = append(names, m.Name)
+		return true
+	}); err != nil {
+		t.Fatal(err)
 	}
-	// remove file if exists
-	filename := filepath.Join(tmpdir, "BenchmarkReads")
-	os.Remove(filename)
-	// open
+	return names
+}
+
+func TestReopenAfterPartialWrite(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestReopenAfterPartialWrite")
 	log, err := Open(filename)
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
-	for i := 0; i < b.N; i++ {
-		if err := log.Write(m); err != nil {
-			b.Fatal(err)
+	for _, name := range []string{"a", "b"} {
+		if err := log.Write(&schema.Mutation{Name: name}); err != nil {
+			t.Fatal(err)
 		}
 	}
-	b.ResetTimer()
-	// read
-	for i := 0; i < b.N; i++ {
-		for _ = range log.Replay() {
-			// noop
+	log.Close()
+	// simulate a crash part way through writing a record
+	segments := log.Segments()
+	f, err := os.OpenFile(segments[len(segments)-1].File, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"00000000-0000-0000-0000-000000000000","na`)
+	f.Close()
+	log, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if pos, err := log.Append(&schema.Mutation{Name: "c"}); err != nil || pos != 3 {
+		t.Fatalf("expected position 3 got %d (%v)", pos, err)
+	}
+	if got := names(t, log); len(got) != 3 || got[2] != "c" {
+		t.Fatalf("expected the partial record to be dropped got %v", got)
+	}
+	n := 0
+	for range log.Replay() {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 records to be replayed got %d", n)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestOpenReadOnly")
+	content := []byte("{\"name\":\"a\"}\n{\"name\":\"b\"}\n")
+	if err := ioutil.WriteFile(filename, content, 0660); err != nil {
+		t.Fatal(err)
+	}
+	log, err := OpenReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, log); len(got) != 2 {
+		t.Fatalf("expected 2 records got %v", got)
+	}
+	if err := log.Write(&schema.Mutation{Name: "c"}); err == nil {
+		t.Fatal("expected write to a read only log to fail")
+	}
+	log.Close()
+	// the single file log is read without being migrated
+	if b, err := ioutil.ReadFile(filename); err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("expected log file to be unchanged (%v)", err)
+	}
+	// a segmented log can be read while it is open for writing
+	filename = filepath.Join(tmpdir, "TestOpenReadOnlySegments")
+	w, err := OpenWith(filename, Options{SegmentSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := w.Write(&schema.Mutation{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log, err = OpenReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if got := names(t, log); len(got) != 3 {
+		t.Fatalf("expected 3 records got %v", got)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestRotation")
+	opts := Options{SegmentSize: 1}
+	log, err := OpenWith(filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := log.Write(&schema.Mutation{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := log.Segments()
+	if len(segments) != 3 {
+		t.Fatalf("expected a segment per record got %+v", segments)
+	}
+	for i, seg := range segments {
+		if seg.First != int64(i+1) || seg.Last != int64(i+1) {
+			t.Fatalf("expected segment %d to hold record %d got %+v", i, i+1, seg)
+		}
+		if seg.Sealed != (i < 2) {
+			t.Fatalf("expected only the active segment to be unsealed got %+v", seg)
 		}
 	}
+	n := 0
+	for m := range log.Replay() {
+		if m.Name != []string{"a", "b", "c"}[n] {
+			t.Fatalf("expected records in order got %s at %d", m.Name, n)
+		}
+		n++
+	}
+	log.Close()
+	// reopening continues numbering from the last segment
+	log, err = OpenWith(filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if log.Len() != 3 {
+		t.Fatalf("expected reopened log to have 3 records got %d", log.Len())
+	}
+	if pos, err := log.Append(&schema.Mutation{Name: "d"}); err != nil || pos != 4 {
+		t.Fatalf("expected position 4 got %d (%v)", pos, err)
+	}
+	if got := names(t, log); len(got) != 4 || got[3] != "d" {
+		t.Fatalf("expected 4 records got %v", got)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestMigrate")
+	if err := ioutil.WriteFile(filename, []byte("{\"name\":\"a\"}\n{\"name\":\"b\"}\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	log, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if fi, err := os.Stat(filename); err != nil || !fi.IsDir() {
+		t.Fatalf("expected log file to become a directory (%v)", err)
+	}
+	if log.Len() != 2 {
+		t.Fatalf("expected migrated log to have 2 records got %d", log.Len())
+	}
+	if err := log.Write(&schema.Mutation{Name: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, log); len(got) != 3 || got[0] != "a" || got[2] != "c" {
+		t.Fatalf("expected old records followed by new got %v", got)
+	}
+	if segments := log.Segments(); len(segments) != 2 || !segments[0].Sealed || segments[0].Last != 2 {
+		t.Fatalf("expected old file to be a sealed segment got %+v", segments)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestArchive")
+	archive := filepath.Join(tmpdir, "TestArchiveDir")
+	log, err := OpenWith(filename, Options{SegmentSize: 1, ArchiveDir: archive, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := log.Write(&schema.Mutation{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := log.Archive(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected only the first segment to be archived got %d", n)
+	}
+	seg := log.Segments()[0]
+	if !seg.Archived || !seg.Compressed || filepath.Dir(seg.File) != archive {
+		t.Fatalf("expected segment to be compressed into the archive got %+v", seg)
+	}
+	// the active segment is never archived
+	if n, err := log.Archive(3); err != nil || n != 1 {
+		t.Fatalf("expected one more segment to be archived got %d (%v)", n, err)
+	}
+	if got := names(t, log); len(got) != 3 || got[0] != "a" {
+		t.Fatalf("expected archived segments to be read got %v", got)
+	}
+	var b bytes.Buffer
+	if _, err := log.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(b.String(), "arla_replay"); lines != 3 {
+		t.Fatalf("expected 3 replay statements got %d", lines)
+	}
+}
+
+func TestWriteToEscapesQuotes(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestWriteToEscapesQuotes")
+	log, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	m := &schema.Mutation{
+		Name: "a",
+		Meta: &schema.Meta{UserAgent: "x'); drop table member; --"},
+	}
+	if err := log.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if _, err := log.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	sql := b.String()
+	if !strings.Contains(sql, "x''); drop table member") {
+		t.Fatalf("expected quotes to be doubled got %s", sql)
+	}
+	// only the quotes around the literal are left once doubled quotes are removed
+	if n := strings.Count(strings.Replace(sql, "''", "", -1), "'"); n != 2 {
+		t.Fatalf("expected a single string literal got %s", sql)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, name := range CodecNames() {
+		codec, err := CodecByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(tmpdir, "TestCodecs-"+name)
+		log, err := OpenWith(filename, Options{Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b"} {
+			if err := log.Write(&schema.Mutation{Name: name, Token: schema.Token{"id": "alice"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// records are readable while the segment is still being written
+		if got := names(t, log); len(got) != 2 {
+			t.Fatalf("%s: expected 2 records before close got %v", name, got)
+		}
+		log.Close()
+		log, err = OpenWith(filename, Options{Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := log.Write(&schema.Mutation{Name: "c"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := names(t, log); len(got) != 3 || got[2] != "c" {
+			t.Fatalf("%s: expected 3 records after reopening got %v", name, got)
+		}
+		segments := log.Segments()
+		if codec.Appendable() != (len(segments) == 1) {
+			t.Fatalf("%s: expected a new segment only if the codec cannot append got %+v", name, segments)
+		}
+		b, err := ioutil.ReadFile(segments[0].File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header := "arla-log 1 " + name + "\n"; !strings.HasPrefix(string(b), header) {
+			t.Fatalf("%s: expected segment to start with header %q", name, header)
+		}
+		log.Close()
+	}
+}
+
+func TestConvert(t *testing.T) {
+	filename := filepath.Join(tmpdir, "TestConvert")
+	// a log from before segments and codecs
+	if err := ioutil.WriteFile(filename, []byte("{\"name\":\"a\",\"args\":[12345678901234567890]}\n{\"name\":\"b\"}\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	n, err := Convert(filename, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 records to be converted got %d", n)
+	}
+	if _, err := os.Stat(filename + ".old"); err != nil {
+		t.Fatalf("expected original log to be kept (%v)", err)
+	}
+	if _, err := Convert(filename, Gzip); err == nil {
+		t.Fatal("expected converting again to refuse to replace the kept log")
+	}
+	log, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if log.Len() != 2 {
+		t.Fatalf("expected converted log to have 2 records got %d", log.Len())
+	}
+	var b bytes.Buffer
+	if _, err := log.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	// records are copied as written rather than re-encoded
+	if !strings.Contains(b.String(), "12345678901234567890") {
+		t.Fatalf("expected record to be unchanged got %s", b.String())
+	}
+}
+
+// benchMutation is a typical record with the fields that repeat between
+// mutations
+func benchMutation() *schema.Mutation {
+	return &schema.Mutation{
+		ID:      schema.TimeUUID(),
+		Name:    "exampleOp",
+		Args:    []interface{}{"some text", 42.0},
+		Token:   schema.Token{"id": "4f1c4b8e-0c43-4f0e-9a53-5a1b7e0c1d2f", "role": "member"},
+		Version: 3,
+		Meta:    &schema.Meta{RequestID: "abcdef0123456789", IP: "203.0.113.7", UserAgent: "Mozilla/5.0"},
+	}
+}
+
+func BenchmarkWrites(b *testing.B) {
+	for _, name := range CodecNames() {
+		codec, _ := CodecByName(name)
+		b.Run(name, func(b *testing.B) {
+			m := benchMutation()
+			// remove file if exists
+			filename := filepath.Join(tmpdir, "BenchmarkWrites-"+name)
+			os.RemoveAll(filename)
+			// open
+			log, err := OpenWith(filename, Options{Codec: codec})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer log.Close()
+			b.ResetTimer()
+			// write alot
+			for i := 0; i < b.N; i++ {
+				if err := log.Write(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReads(b *testing.B) {
+	for _, name := range CodecNames() {
+		codec, _ := CodecByName(name)
+		b.Run(name, func(b *testing.B) {
+			m := benchMutation()
+			// remove file if exists
+			filename := filepath.Join(tmpdir, "BenchmarkReads-"+name)
+			os.RemoveAll(filename)
+			// open
+			log, err := OpenWith(filename, Options{Codec: codec})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer log.Close()
+			for i := 0; i < b.N; i++ {
+				if err := log.Write(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			// read
+			for i := 0; i < b.N; i++ {
+				for _ = range log.Replay() {
+					// noop
+				}
+			}
+		})
+	}
 }
@@ -0,0 +1,234 @@
+// Package querycache is an in-memory LRU cache of query results with a
+// byte budget. Entries record the tables that were read to produce them so
+// that mutations only invalidate the results they could have changed.
+package querycache
+
+import (
+	"arla/schema"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// entryOverhead approximates the memory used by an entry besides its value
+const entryOverhead = 128
+
+// Stats are counters describing the cache's effectiveness
+type Stats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Uncacheable   int64 `json:"uncacheable"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	MaxBytes      int64 `json:"maxBytes"`
+}
+
+type entry struct {
+	key    string
+	value  []byte
+	tables []string
+	size   int64
+}
+
+// Cache is a size limited LRU cache of query results
+type Cache struct {
+	maxBytes   int64
+	mu         sync.Mutex
+	ll         *list.List
+	items      map[string]*list.Element
+	generation uint64
+	stats      Stats
+}
+
+// New creates a cache holding up to maxBytes of results. A size of zero or
+// less returns nil, which is a valid disabled cache.
+func New(maxBytes int64) *Cache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &Cache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Enabled returns false for a nil cache
+func (c *Cache) Enabled() bool {
+	return c != nil
+}
+
+// Get returns the cached result for key
+func (c *Cache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*entry).value, true
+}
+
+// Generation returns a counter that changes on every invalidation. Pass it
+// to Put so that results computed while a mutation was being committed are
+// not stored.
+func (c *Cache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Put stores the result of a query that read the given tables. Results are
+// discarded if the cache has been invalidated since generation was read or
+// if they are larger than the whole budget.
+func (c *Cache) Put(key string, value []byte, tables []string, generation uint64) {
+	if c == nil {
+		return
+	}
+	e := &entry{
+		key:    key,
+		value:  value,
+		tables: tables,
+		size:   int64(len(key)+len(value)) + entryOverhead,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation || e.size > c.maxBytes {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.stats.Bytes += e.size
+	for c.stats.Bytes > c.maxBytes {
+		c.remove(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove deletes an element. Must be called with mu held.
+func (c *Cache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*entry)
+	delete(c.items, e.key)
+	c.stats.Bytes -= e.size
+}
+
+// Invalidate removes every result that read any of the tables
+func (c *Cache) Invalidate(tables []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if len(tables) == 0 {
+		return
+	}
+	changed := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		changed[t] = true
+	}
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		for _, t := range el.Value.(*entry).tables {
+			if changed[t] {
+				c.remove(el)
+				c.stats.Invalidations++
+				break
+			}
+		}
+		el = next
+	}
+}
+
+// Purge removes every result
+func (c *Cache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.stats.Invalidations += int64(len(c.items))
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.stats.Bytes = 0
+}
+
+// Uncacheable counts a query that could not be cached
+func (c *Cache) Uncacheable() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.stats.Uncacheable++
+	c.mu.Unlock()
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *Cache) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.items)
+	s.MaxBytes = c.maxBytes
+	return s
+}
+
+// Key returns the cache key for a query, its args and the claims its
+// result depends on.
+func Key(query string, args []interface{}, claims map[string]interface{}) (string, error) {
+	b, err := json.Marshal(&struct {
+		Query  string                 `json:"query"`
+		Args   []interface{}          `json:"args"`
+		Claims map[string]interface{} `json:"claims"`
+	}{query, args, claims})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Claims returns the token claims that the result of a query selecting the
+// roots properties depends on according to their cache policies. It returns
+// false if any root property is not cacheable.
+func Claims(policies map[string]schema.CachePolicy, roots []string, token schema.Token) (map[string]interface{}, bool) {
+	if len(roots) == 0 {
+		return nil, false
+	}
+	claims := map[string]interface{}{}
+	for _, name := range roots {
+		policy, ok := policies[name]
+		if !ok {
+			return nil, false
+		}
+		if policy.Session {
+			for k, v := range token {
+				claims[k] = v
+			}
+			continue
+		}
+		for _, k := range policy.Claims {
+			claims[k] = token[k]
+		}
+	}
+	return claims, true
+}
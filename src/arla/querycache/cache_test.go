@@ -0,0 +1,95 @@
+package querycache
+
+import (
+	"arla/schema"
+	"reflect"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	value := make([]byte, 100)
+	size := int64(len("a") + len(value) + entryOverhead)
+	c := New(2 * size)
+	c.Put("a", value, nil, 0)
+	c.Put("b", value, nil, 0)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	c.Put("c", value, nil, 0)
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected recently used entry to be kept")
+	}
+	s := c.Stats()
+	if s.Entries != 2 || s.Bytes != 2*size || s.Evictions != 1 || s.Hits != 2 || s.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	c.Put("big", make([]byte, 3*size), nil, 0)
+	if _, ok := c.Get("big"); ok {
+		t.Fatal("expected entry larger than the cache to be skipped")
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c := New(1 << 20)
+	gen := c.Generation()
+	c.Put("members", []byte("[]"), []string{"member"}, gen)
+	c.Put("countries", []byte("[]"), []string{"country"}, gen)
+	c.Invalidate([]string{"member", "email_address"})
+	if _, ok := c.Get("members"); ok {
+		t.Fatal("expected entry reading a changed table to be invalidated")
+	}
+	if _, ok := c.Get("countries"); !ok {
+		t.Fatal("expected entry reading other tables to be kept")
+	}
+	// a result computed before the invalidation must not be stored
+	c.Put("members", []byte("[]"), []string{"member"}, gen)
+	if _, ok := c.Get("members"); ok {
+		t.Fatal("expected stale result to be discarded")
+	}
+	c.Purge()
+	if s := c.Stats(); s.Entries != 0 || s.Bytes != 0 || s.Invalidations != 2 {
+		t.Fatalf("expected purge to remove everything got %+v", s)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	var c *Cache = New(0)
+	c.Put("a", []byte("x"), nil, c.Generation())
+	if _, ok := c.Get("a"); ok || c.Enabled() {
+		t.Fatal("expected zero sized cache to be disabled")
+	}
+	c.Invalidate(nil)
+}
+
+func TestClaims(t *testing.T) {
+	policies := map[string]schema.CachePolicy{
+		"countries": {},
+		"me":        {Claims: []string{"id"}},
+		"session":   {Session: true},
+	}
+	token := schema.Token{"id": "alice", "admin": true}
+	for _, tc := range []struct {
+		roots  []string
+		claims map[string]interface{}
+	}{
+		{[]string{"countries"}, map[string]interface{}{}},
+		{[]string{"me", "countries"}, map[string]interface{}{"id": "alice"}},
+		{[]string{"session"}, map[string]interface{}{"id": "alice", "admin": true}},
+		{[]string{"members"}, nil},
+		{[]string{"me", "members"}, nil},
+		{nil, nil},
+	} {
+		claims, ok := Claims(policies, tc.roots, token)
+		if ok != (tc.claims != nil) || (ok && !reflect.DeepEqual(claims, tc.claims)) {
+			t.Fatalf("%v: expected %v got %v (%v)", tc.roots, tc.claims, claims, ok)
+		}
+	}
+	a, _ := Key(`me(){username}`, nil, map[string]interface{}{"id": "alice"})
+	b, _ := Key(`me(){username}`, nil, map[string]interface{}{"id": "bob"})
+	if a == b {
+		t.Fatal("expected keys to depend on claims")
+	}
+}
@@ -0,0 +1,81 @@
+package querystore
+
+import (
+	"arla/schema"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+import "github.com/jackc/pgx"
+
+// QueryBatch runs the queries in a single REPEATABLE READ transaction on one
+// connection so that they all see the same snapshot of the data. Results
+// and errors are returned for each query and a query that fails does not
+// affect the others. Only a failure of the whole transaction (such as ctx
+// being done) is returned as err. The query cache is not used as its
+// entries may come from a different snapshot.
+func (p *postgres) QueryBatch(ctx context.Context, queries []*schema.Query) (results []json.RawMessage, errs []error, err error) {
+	results = make([]json.RawMessage, len(queries))
+	errs = make([]error, len(queries))
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	conn, err := p.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer p.release(conn)
+	// statements must be prepared before the transaction starts
+	stmts := make([]*compiled, len(queries))
+	for i, q := range queries {
+		if q.ID == "" {
+			continue
+		}
+		text, ok := p.PersistedQuery(q.ID)
+		if !ok {
+			errs[i] = fmt.Errorf("unknown persisted query %s", q.ID)
+			continue
+		}
+		q.Query = text
+		stmts[i], errs[i] = p.prepare(conn, q.ID, q)
+	}
+	err = p.runTxIso(ctx, conn, pgx.RepeatableRead, func(tx *pgx.Tx) error {
+		for i, q := range queries {
+			if errs[i] != nil {
+				continue
+			}
+			// a savepoint stops a failing query aborting the transaction
+			if _, err := tx.Exec("savepoint arla_batch"); err != nil {
+				return err
+			}
+			var res bytes.Buffer
+			out := jsonbytes{w: &res}
+			var err error
+			if stmts[i] != nil {
+				err = tx.QueryRow(stmts[i].name, stmts[i].values(q)...).Scan(&out)
+			} else {
+				var b []byte
+				if b, err = json.Marshal(q); err == nil {
+					err = tx.QueryRow("select arla_query($1::json)", string(b)).Scan(&out)
+				}
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				errs[i] = err
+				if _, err := tx.Exec("rollback to savepoint arla_batch"); err != nil {
+					return err
+				}
+				continue
+			}
+			results[i] = res.Bytes()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, errs, nil
+}
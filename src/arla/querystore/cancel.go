@@ -0,0 +1,128 @@
+package querystore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+import "github.com/jackc/pgx"
+
+// cancelRequestCode is the protocol code of a CancelRequest message
+const cancelRequestCode = 80877102
+
+// poolTx runs fn in a transaction on a connection from pool. See runTx.
+func (p *postgres) poolTx(ctx context.Context, pool *pgx.ConnPool, fn func(*pgx.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer pool.Release(conn)
+	return p.runTx(ctx, conn, fn)
+}
+
+// runTx runs fn in a transaction on conn. The statement_timeout of the
+// transaction is set from the ctx deadline and the backend is cancelled if
+// ctx is done before fn returns, in which case the ctx error is returned.
+// The transaction is committed if fn succeeds.
+func (p *postgres) runTx(ctx context.Context, conn *pgx.Conn, fn func(*pgx.Tx) error) error {
+	return p.runTxIso(ctx, conn, "", fn)
+}
+
+// runTxIso is runTx with a transaction isolation level. An empty level
+// uses the database default.
+func (p *postgres) runTxIso(ctx context.Context, conn *pgx.Conn, iso string, fn func(*pgx.Tx) error) error {
+	var tx *pgx.Tx
+	var err error
+	if iso == "" {
+		tx, err = conn.Begin()
+	} else {
+		tx, err = conn.BeginIso(iso)
+	}
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := int64(time.Until(deadline) / time.Millisecond)
+		if ms <= 0 {
+			return context.DeadlineExceeded
+		}
+		if _, err := tx.Exec("select set_config('statement_timeout', $1, true)", strconv.FormatInt(ms, 10)); err != nil {
+			return err
+		}
+	}
+	stop := p.cancelOnDone(ctx, conn)
+	err = fn(tx)
+	stop()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// cancelOnDone cancels the statement running on conn if ctx is done before
+// the returned func is called. The returned func waits for any cancel
+// request to complete so that it cannot affect the next use of conn.
+func (p *postgres) cancelOnDone(ctx context.Context, conn *pgx.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	finished := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			if err := p.cancelBackend(conn.Pid, conn.SecretKey); err != nil {
+				fmt.Fprintf(p.log, "WARNING: failed to cancel query: %v\n", err)
+			}
+		case <-finished:
+		}
+	}()
+	return func() {
+		close(finished)
+		<-exited
+	}
+}
+
+// cancelBackend asks postgres to cancel the statement being run by the
+// backend with pid. This is the same as pg_cancel_backend but uses the
+// protocol's CancelRequest message so it does not need a free connection.
+func (p *postgres) cancelBackend(pid, secretKey int32) error {
+	port := p.pgcfg.Port
+	if port == 0 {
+		port = 5432
+	}
+	network, address := "tcp", net.JoinHostPort(p.pgcfg.Host, strconv.Itoa(int(port)))
+	if filepath.IsAbs(p.pgcfg.Host) {
+		network, address = "unix", filepath.Join(p.pgcfg.Host, ".s.PGSQL."+strconv.Itoa(int(port)))
+	}
+	c, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := make([]byte, 16)
+	binary.BigEndian.PutUint32(msg[0:4], 16)
+	binary.BigEndian.PutUint32(msg[4:8], cancelRequestCode)
+	binary.BigEndian.PutUint32(msg[8:12], uint32(pid))
+	binary.BigEndian.PutUint32(msg[12:16], uint32(secretKey))
+	if _, err := c.Write(msg); err != nil {
+		return err
+	}
+	// the server closes the connection once the request is processed
+	var b [1]byte
+	c.Read(b[:])
+	return nil
+}
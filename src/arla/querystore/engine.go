@@ -1,7 +1,10 @@
 package querystore
 
 import (
+	"arla/querycache"
 	"arla/schema"
+	"context"
+	"encoding/json"
 	"io"
 	"os"
 )
@@ -11,14 +14,24 @@ type Engine interface {
 	Start() error
 	Stop() error
 	Wait() error
-	Mutate(*schema.Mutation) error
-	Query(*schema.Query, io.Writer) error
+	Mutate(context.Context, *schema.Mutation) (json.RawMessage, error)
+	DryRun(context.Context, *schema.Mutation) (json.RawMessage, error)
+	Query(context.Context, *schema.Query, io.Writer) error
+	QueryBatch(context.Context, []*schema.Query) ([]json.RawMessage, []error, error)
 	NewWriter() (w io.WriteCloser, err error)
 	SetLogLevel(logLevel)
 	GetLogLevel() logLevel
-	Authenticate(string) (schema.Token, error)
-	Register(string) (*schema.Mutation, error)
+	Authenticate(context.Context, string) (schema.Token, error)
+	Register(context.Context, string) (*schema.Mutation, error)
+	APIKey(hash string) (*schema.APIKey, error)
+	APIKeys() ([]*schema.APIKey, error)
+	TOTP(subject string) (*schema.TOTP, error)
 	Info() (*schema.Info, error)
+	CacheStats() querycache.Stats
+	PersistedQuery(id string) (string, bool)
+	RootProperties(context.Context, string) ([]string, error)
+	Digest() (map[string]string, error)
+	Divergences() ([]*schema.Divergence, error)
 }
 
 // Config defines options configuring the query engine
@@ -26,14 +39,30 @@ type Config struct {
 	Path           string
 	LogLevel       logLevel
 	MaxConnections int
+	// AuthConnections is the number of extra connections reserved for
+	// Authenticate, Register and TOTP. Zero shares the query connections.
+	AuthConnections int
+	// QueriesDir is a directory of .aql files that are loaded as persisted
+	// queries along with any declared in the app config
+	QueriesDir string
+	// CacheSize is the number of bytes of query results to cache. Zero
+	// disables the cache.
+	CacheSize int64
 }
 
+// rootsCacheSize is the number of bytes of query text and root property
+// names remembered by RootProperties
+const rootsCacheSize = 1 << 20
+
 // New creates a new query engine (which is always postgres at the moment)
 func New(cfg *Config) (e Engine, err error) {
 	p := &postgres{
-		cfg:            cfg,
-		log:            NewLogFormatter(os.Stderr),
-		maxConnections: cfg.MaxConnections,
+		cfg:             cfg,
+		log:             NewLogFormatter(os.Stderr),
+		maxConnections:  cfg.MaxConnections,
+		authConnections: cfg.AuthConnections,
+		cache:           querycache.New(cfg.CacheSize),
+		roots:           querycache.New(rootsCacheSize),
 	}
 	p.SetLogLevel(cfg.LogLevel)
 	return p, p.Start()
@@ -3,6 +3,7 @@ package querystore
 import (
 	"arla/schema"
 	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"os"
@@ -31,7 +32,7 @@ func TestMutate(t *testing.T) {
 		Name: "exampleOp",
 		Args: []interface{}{1, 2, 3},
 	}
-	err := qs.Mutate(m)
+	_, err := qs.Mutate(context.Background(), m)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -50,6 +50,12 @@ class MutationError extends Error {
 	var schema = {};
 	var actions = {};
 
+	// BATCH is the name of a mutation that applies a list of mutations
+	const BATCH = 'arla.batch';
+
+	// CHECKPOINT is the name of a log record holding a digest of the state
+	const CHECKPOINT = 'arla.checkpoint';
+
 	const ARRAY_OF_SIMPLE = 1;
 	const ARRAY_OF_OBJECTS = 2;
 	const SIMPLE = 3;
@@ -59,6 +65,59 @@ class MutationError extends Error {
 		actions[name] = fn;
 	}
 
+	// systemActions are mutations generated by the server itself. They are
+	// never transformed and cannot be overridden by the user's config.
+	var systemActions = {
+		'arla.createApiKey': function(id, hash, name, claims, allowed, ips, created){
+			return [`
+				insert into arla_api_key (id, hash, name, claims, actions, ips, created)
+				values ($1, $2, $3, $4, $5, $6, to_timestamp($7))
+			`, id, hash, name || '', JSON.stringify(claims || {}), JSON.stringify(allowed || []), JSON.stringify(ips || []), created];
+		},
+		'arla.revokeApiKey': function(id, revoked){
+			return [`
+				update arla_api_key set revoked = to_timestamp($2)
+				where id = $1 and revoked is null
+			`, id, revoked];
+		},
+		'arla.enableTotp': function(subject, secret, recovery, enabled, step){
+			this.query(`delete from arla_totp where subject = $1`, subject);
+			return [`
+				insert into arla_totp (subject, secret, recovery, enabled, last_step)
+				values ($1, $2, $3, to_timestamp($4), $5)
+			`, subject, secret, JSON.stringify(recovery || []), enabled, step || null];
+		},
+		'arla.disableTotp': function(subject){
+			return [`
+				delete from arla_totp where subject = $1
+			`, subject];
+		},
+		'arla.useTotpCode': function(subject, step){
+			let rows = this.query(`
+				update arla_totp set last_step = $2
+				where subject = $1 and coalesce(last_step, 0) < $2
+				returning subject
+			`, subject, step);
+			if( rows.length == 0 ){
+				throw new UserError('two-factor code has already been used');
+			}
+		},
+		'arla.useTotpRecoveryCode': function(subject, hash){
+			let rows = this.query(`
+				update arla_totp set recovery = (
+					select coalesce(json_agg(h), '[]'::json)
+					from json_array_elements_text(recovery) h
+					where h != $2
+				)
+				where subject = $1 and recovery::jsonb ? $2
+				returning subject
+			`, subject, hash);
+			if( rows.length == 0 ){
+				throw new UserError('recovery code has already been used');
+			}
+		},
+	};
+
 	function addListener(kind, op, klass, fn){
 		fn.klass = klass;
 		listeners[klass.name] = op.trim().split(/\s/g).reduce(function(ops, op){
@@ -140,7 +199,7 @@ class MutationError extends Error {
 				case 'boolean':   def = `false`;                         break;
 				case 'json':
 				case 'jsonb':     def = type=='array' ? `'[]'` : `'{}'`; break;
-				case 'timestampz':def = `now()`;                         break;
+				case 'timestampz':def = `arla_now()`;                    break;
 			}
 		}
 		if( pk ){
@@ -696,11 +755,207 @@ class MutationError extends Error {
 	};
 
 	arla.replay = function(m){
+		if( m.name == CHECKPOINT ){
+			return checkpoint(m);
+		}
 		arla.exec(m, true);
 		return true;
 	};
 
+	// digest returns a digest of the contents of each table. A table's
+	// digest is its row count and the sum of a hash of each row so it does
+	// not depend on the order of the rows.
+	arla.digest = function(){
+		let digest = {};
+		db.query(`
+			select tablename from pg_tables
+			where schemaname = current_schema() and tablename != 'arla_divergence'
+		`).forEach(function(t){
+			let r = db.query(`
+				select count(*)::text as n,
+					coalesce(sum(('x' || substr(md5(t::text), 1, 15))::bit(60)::bigint), 0)::text as h
+				from ${ plv8.quote_ident(t.tablename) } t
+			`)[0];
+			digest[t.tablename] = `${r.n}:${r.h}`;
+		});
+		return digest;
+	};
+
+	// lastCheckpoint is the log position of the last checkpoint replayed
+	var lastCheckpoint = 0;
+
+	// checkpoint compares the digest recorded in a checkpoint with the
+	// replayed state and records any table that differs along with the range
+	// of mutations since the previous checkpoint that caused it.
+	function checkpoint(m){
+		let seq = (m.meta && m.meta.seq) || 0;
+		let expected = m.digest || {};
+		let actual = arla.digest();
+		Object.keys(Object.assign({}, expected, actual)).forEach(function(table){
+			if( expected[table] === actual[table] ){
+				return;
+			}
+			db.query(`
+				insert into arla_divergence (tbl, from_seq, to_seq, expected, actual)
+				select $1::text, $2::bigint, $3::bigint, $4::text, $5::text
+				where not exists (select 1 from arla_divergence where tbl = $1::text)
+			`, table, lastCheckpoint + 1, seq, expected[table] || null, actual[table] || null);
+		});
+		lastCheckpoint = seq;
+		return true;
+	}
+
+	// pinned holds the time and random state of the mutation being executed
+	// so that replaying it produces the same values as the original exec
+	var pinned = null;
+
+	// pin returns the pinned state for a mutation's metadata. Mutations
+	// logged without metadata are not pinned.
+	function pin(meta){
+		if( !meta || !meta.received ){
+			return null;
+		}
+		return {
+			now: new Date(meta.received),
+			random: seededRandom(meta.seed),
+		};
+	}
+
+	// seededRandom returns a generator of numbers in [0, 1) that always
+	// produces the same sequence for the same seed. Seeds are 128 bits of
+	// hex which fill the state of xoshiro128**. Older logs have 32 bit
+	// number seeds which are replayed with mulberry32.
+	function seededRandom(seed){
+		if( typeof seed == 'string' && /^[0-9a-f]{32}$/i.test(seed) ){
+			return xoshiro128(seed);
+		}
+		if( typeof seed == 'number' ){
+			return mulberry32(seed);
+		}
+		return null;
+	}
+
+	function xoshiro128(seed){
+		let s = [0, 1, 2, 3].map(i => parseInt(seed.substr(i*8, 8), 16) | 0);
+		if( !(s[0] | s[1] | s[2] | s[3]) ){
+			// the all zero state only ever produces zeros
+			s[0] = 1;
+		}
+		let rotl = (x, k) => (x << k) | (x >>> (32 - k));
+		return function(){
+			let r = Math.imul(rotl(Math.imul(s[1], 5), 7), 9);
+			let t = s[1] << 9;
+			s[2] ^= s[0];
+			s[3] ^= s[1];
+			s[1] ^= s[2];
+			s[0] ^= s[3];
+			s[2] ^= t;
+			s[3] = rotl(s[3], 11);
+			return (r >>> 0) / 4294967296;
+		};
+	}
+
+	function mulberry32(seed){
+		let a = seed >>> 0;
+		return function(){
+			a = (a + 0x6D2B79F5) | 0;
+			let t = Math.imul(a ^ (a >>> 15), 1 | a);
+			t = (t + Math.imul(t ^ (t >>> 7), 61 | t)) ^ t;
+			return ((t ^ (t >>> 14)) >>> 0) / 4294967296;
+		};
+	}
+
+	// now returns the time the mutation being executed was received, or the
+	// current time outside of an exec. Actions should use it (or arla_now()
+	// in sql) rather than now() so that replays are reproducible.
+	arla.now = function(){
+		return pinned ? new Date(pinned.now.getTime()) : new Date();
+	};
+
+	// random is Math.random seeded by the mutation being executed
+	arla.random = function(){
+		return pinned && pinned.random ? pinned.random() : Math.random();
+	};
+
+	// uuid returns a v4 uuid generated from arla.random
+	arla.uuid = function(){
+		let b = [];
+		for(let i=0; i<16; i++){
+			b.push(Math.floor(arla.random() * 256));
+		}
+		b[6] = (b[6] & 0x0f) | 0x40;
+		b[8] = (b[8] & 0x3f) | 0x80;
+		let h = b.map(x => (x < 16 ? '0' : '') + x.toString(16)).join('');
+		return `${h.substr(0,8)}-${h.substr(8,4)}-${h.substr(12,4)}-${h.substr(16,4)}-${h.substr(20)}`;
+	};
+
+	// execBatch runs each mutation of a batch in order with the batch's
+	// version and session. The batch is executed by a single statement so
+	// either every mutation is applied or none are. Errors report the index
+	// of the mutation that failed.
+	function execBatch(m, replay){
+		if( !Array.isArray(m.batch) || m.batch.length == 0 ){
+			throw new UserError('batch must contain at least one mutation');
+		}
+		return m.batch.map(function(item, index){
+			let sub = Object.assign({}, item, {version: m.version, token: m.token, meta: m.meta});
+			try{
+				if( sub.name == BATCH ){
+					throw new UserError('batches cannot be nested');
+				}
+				return arla.exec(sub, replay);
+			}catch(e){
+				let o = {message: e.message, mutation: sub};
+				if( e.name == 'MutationError' ){
+					o = JSON.parse(e.message);
+					o.message = o.error;
+					delete o.error;
+				}
+				o.index = index;
+				throw new MutationError(o);
+			}
+		});
+	}
+
+	// result returns what the action fn declares it returns given the
+	// result of its sql (the rows of a select or RETURNING clause, otherwise
+	// the number of rows affected). Actions can set fn.returns to:
+	//   'rows' (default) - the result of the sql
+	//   'row'            - the first row or null
+	//   'none'           - nothing
+	//   a function       - called with the result and the action's args
+	function result(fn, cxt, m, res){
+		switch( fn.returns ){
+		case undefined:
+		case 'rows':
+			return res;
+		case 'row':
+			return Array.isArray(res) && res.length > 0 ? res[0] : null;
+		case 'none':
+			return null;
+		}
+		if( typeof fn.returns == 'function' ){
+			return fn.returns.call(cxt, res, ...m.args);
+		}
+		throw new UserError(`action ${m.name} has invalid returns ${fn.returns}`);
+	}
+
+	// exec pins the time and random state to those recorded in the
+	// mutation's metadata while it is executed. The mutations of a batch
+	// share the state of the batch.
 	arla.exec = function(m, replay){
+		let outer = pinned;
+		if( !outer ){
+			pinned = pin(m.meta);
+		}
+		try{
+			return exec(m, replay);
+		}finally{
+			pinned = outer;
+		}
+	};
+
+	function exec(m, replay){
 		if( !m.name ){
 			throw new UserError('invalid action name');
 		}
@@ -713,10 +968,13 @@ class MutationError extends Error {
 				mutation: m
 			});
 		}
+		if( m.name == BATCH ){
+			return execBatch(m, replay);
+		}
 		// if mutation is for an older version
 		// ask the transform function to update it
 		let iter = 0;
-		while( m.version < arla.cfg.version ){
+		while( m.version < arla.cfg.version && !systemActions[m.name] ){
 			// catch infinite recursion (ok 1000 isn't really infinite but if you
 			// have 1000 versions you have bigger problems.)
 			if( iter > 1000 ){
@@ -732,7 +990,7 @@ class MutationError extends Error {
 			m = arla.cfg.transform(m, arla.cfg.version);
 			iter++;
 		}
-		var fn = actions[m.name];
+		var fn = systemActions[m.name] || actions[m.name];
 		if( !fn ){
 			if( /^[a-zA-Z0-9_]+$/.test(m.name) ){
 				throw new UserError(`no such action ${m.name}`);
@@ -745,6 +1003,8 @@ class MutationError extends Error {
 		let cxt = {
 			session:m.token,
 			replay:replay,
+			// request metadata is only given to actions that set fn.meta
+			meta: fn.meta ? m.meta : undefined,
 			query: function(sql, ...args){
 				return db.query(sql, ...args);
 			},
@@ -758,7 +1018,7 @@ class MutationError extends Error {
 		});
 		console.debug(`action ${m.name} returned`, queryArgs);
 		if( !queryArgs ){
-			return;
+			return result(fn, cxt, m, null);
 		}
 		if( !Array.isArray(queryArgs) ){
 			queryArgs = [queryArgs];
@@ -768,8 +1028,9 @@ class MutationError extends Error {
 			throw new UserError('invalid response from action. should be: [sqlstring, ...args]');
 		}
 		// run the query returned from the mutation func
+		let res;
 		try{
-			return db.query(...queryArgs);
+			res = db.query(...queryArgs);
 		}catch(e){
 			if(e.stack){
 				console.debug(e.stack);
@@ -784,14 +1045,15 @@ class MutationError extends Error {
 				mutation: m
 			});
 		}
-	};
+		return result(fn, cxt, m, res);
+	}
 
-	arla.query = function({query, args, token}){
+	// parseQuery converts AQL into a normalized root ast
+	function parseQuery(query){
 		if( !query ){
 			throw new QueryError({error:'arla_query: query text cannot be null'});
 		}
 		query = `root(){ ${query} }`;
-		console.debug('AQL:', query, args);
 		let ast;
 		try{
 			ast = gql.parse(query);
@@ -824,12 +1086,68 @@ class MutationError extends Error {
 		if( ast.name != 'root' ){
 			throw new QueryError({message:`expected root() property got ${ast.name}`});
 		}
+		return ast;
+	}
+
+	arla.query = function({query, args, token}){
+		console.debug('AQL:', query, args);
+		let ast = parseQuery(query);
 		let sql = sqlForClass(schema.root, token, ast, args);
 		let res = db.query(sql)[0];
 		// console.debug('RESULT', res);
 		return res;
 	};
 
+	// roots returns the names of the root properties selected by a query,
+	// ignoring aliases. They are the properties that arla.query would run.
+	arla.roots = function({query}){
+		return parseQuery(query).props.map(p => p.name);
+	};
+
+	// compile generates the sql for a persisted query so that it can be
+	// prepared once and reused. String and number args and session claims
+	// are replaced by markers that become statement parameters, other values
+	// are compiled in as they are. If a marker is used in any way other than
+	// as a whole value the query cannot be parameterized and sql is null.
+	// Without args and a token the query is only checked for syntax errors.
+	arla.compile = function({query, args, token}){
+		let ast = parseQuery(query);
+		if( !args && !token ){
+			return {sql: null, params: []};
+		}
+		let params = [];
+		let marker = function(v, param){
+			if( typeof v != 'string' && typeof v != 'number' ){
+				return v;
+			}
+			params.push(param);
+			return `\u001a${params.length}\u001a`;
+		};
+		let vars = (args || []).map((v, i) => marker(v, {arg: i+1}));
+		let session = Object.keys(token || {}).reduce(function(o, k){
+			o[k] = marker(token[k], {claim: k});
+			return o;
+		}, {});
+		let sql = sqlForClass(schema.root, session, ast, vars);
+		// quoted markers become parameters numbered in order of use
+		let used = [];
+		sql = sql.replace(/'\u001a(\d+)\u001a'/g, function(match, n){
+			let i = used.indexOf(n);
+			if( i == -1 ){
+				used.push(n);
+				i = used.length - 1;
+			}
+			return `$${i+1}`;
+		});
+		if( sql.indexOf('\u001a') != -1 ){
+			return {sql: null, params: []};
+		}
+		return {
+			sql: `select row_to_json(arla_q) from (${sql}) arla_q`,
+			params: used.map(n => params[n-1]),
+		};
+	};
+
 	arla.authenticate = function(values){
 		var res = db.query.apply(db, arla.cfg.authenticate(values));
 		if( res.length < 1 ){
@@ -0,0 +1,370 @@
+package querystore
+
+import (
+	"arla/schema"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+import "github.com/jackc/pgx"
+
+// persistedExt is the extension of files containing persisted queries
+const persistedExt = ".aql"
+
+// maxCompiled is the number of compiled statements kept for persisted
+// queries. Every shape of args and claims compiles to its own statement, so
+// the least recently used are dropped and deallocated beyond this.
+const maxCompiled = 512
+
+// compiled is the prepared form of a persisted query for a particular
+// shape of args and claims
+type compiled struct {
+	key    string
+	name   string
+	sql    string
+	params []compiledParam
+	// broken is set if the sql could not be prepared
+	broken bool
+}
+
+// compiledParam says where the value of a statement parameter comes from
+type compiledParam struct {
+	Arg   int    `json:"arg,omitempty"`
+	Claim string `json:"claim,omitempty"`
+}
+
+// persisted holds the allow-listed queries and their compiled statements
+type persisted struct {
+	queries  map[string]string
+	mu       sync.Mutex
+	ll       *list.List
+	compiled map[string]*list.Element
+	// prepared maps the statements prepared on each connection to their key
+	prepared map[*pgx.Conn]map[string]string
+}
+
+// get returns the compiled statement for key and marks it as recently used
+func (ps *persisted) get(key string) (*compiled, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	el, ok := ps.compiled[key]
+	if !ok {
+		return nil, false
+	}
+	ps.ll.MoveToFront(el)
+	return el.Value.(*compiled), true
+}
+
+// put stores c, evicting the least recently used statements if there are
+// more than maxCompiled. It returns the statement already stored for the
+// key if another request compiled it first.
+func (ps *persisted) put(c *compiled) *compiled {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if el, ok := ps.compiled[c.key]; ok {
+		ps.ll.MoveToFront(el)
+		return el.Value.(*compiled)
+	}
+	ps.compiled[c.key] = ps.ll.PushFront(c)
+	for ps.ll.Len() > maxCompiled {
+		old := ps.ll.Remove(ps.ll.Back()).(*compiled)
+		delete(ps.compiled, old.key)
+	}
+	return c
+}
+
+// stale returns the statements prepared on conn that have since been
+// evicted and forgets them
+func (ps *persisted) stale(conn *pgx.Conn) []string {
+	if ps == nil {
+		return nil
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var names []string
+	for name, key := range ps.prepared[conn] {
+		if el, ok := ps.compiled[key]; !ok || el.Value.(*compiled).name != name {
+			names = append(names, name)
+			delete(ps.prepared[conn], name)
+		}
+	}
+	return names
+}
+
+// markPrepared records that the statement c has been prepared on conn
+func (ps *persisted) markPrepared(conn *pgx.Conn, c *compiled) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.prepared[conn] == nil {
+		ps.prepared[conn] = make(map[string]string)
+	}
+	ps.prepared[conn][c.name] = c.key
+}
+
+// forget drops the record of statements prepared on conn
+func (ps *persisted) forget(conn *pgx.Conn) {
+	if ps == nil {
+		return
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.prepared, conn)
+}
+
+// loadQueries reads the persisted queries from the .aql files in dir and
+// the app config and checks that they parse
+func (p *postgres) loadQueries(dir string) error {
+	queries := map[string]string{}
+	for id, text := range p.info.Queries {
+		queries[id] = text
+	}
+	if dir != "" {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("persisted queries path %s is not a directory", dir)
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*"+persistedExt))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			id := strings.TrimSuffix(filepath.Base(f), persistedExt)
+			if _, ok := queries[id]; ok {
+				return fmt.Errorf("persisted query %s is declared more than once", id)
+			}
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			queries[id] = string(b)
+		}
+	}
+	for id, text := range queries {
+		b, err := json.Marshal(&schema.Query{Query: text})
+		if err != nil {
+			return err
+		}
+		var res interface{}
+		if err := p.queryPool.QueryRow("select arla_compile($1::json)", string(b)).Scan(&res); err != nil {
+			return fmt.Errorf("invalid persisted query %s: %v", id, err)
+		}
+	}
+	p.persisted = &persisted{
+		queries:  queries,
+		ll:       list.New(),
+		compiled: make(map[string]*list.Element),
+		prepared: make(map[*pgx.Conn]map[string]string),
+	}
+	return nil
+}
+
+// PersistedQuery returns the text of the persisted query with id
+func (p *postgres) PersistedQuery(id string) (string, bool) {
+	if p.persisted == nil {
+		return "", false
+	}
+	text, ok := p.persisted.queries[id]
+	return text, ok
+}
+
+// compileKey identifies the statement for a query with args and token.
+// String and number values become statement parameters so only their
+// position matters, other values are compiled into the sql.
+func compileKey(id string, args []interface{}, token schema.Token) (string, error) {
+	shape := func(v interface{}) interface{} {
+		switch v.(type) {
+		case string, float64:
+			return "$"
+		}
+		return v
+	}
+	claims := make([]string, 0, len(token))
+	for k := range token {
+		claims = append(claims, k)
+	}
+	sort.Strings(claims)
+	var key []interface{}
+	for _, v := range args {
+		key = append(key, shape(v))
+	}
+	for _, k := range claims {
+		key = append(key, k, shape(token[k]))
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return id + string(b), nil
+}
+
+// compile returns the statement for the persisted query, generating it
+// with conn the first time a query is run with this shape of args and
+// claims. Using the caller's connection means that a request never waits on
+// the pool for a second one while holding the first.
+func (p *postgres) compile(conn *pgx.Conn, id string, q *schema.Query) (*compiled, error) {
+	key, err := compileKey(id, q.Args, q.Token)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := p.persisted.get(key); ok {
+		return c, nil
+	}
+	b, err := json.Marshal(&schema.Query{
+		Query: p.persisted.queries[id],
+		Args:  append([]interface{}{}, q.Args...),
+		Token: q.Token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		SQL    *string         `json:"sql"`
+		Params []compiledParam `json:"params"`
+	}
+	if err := conn.QueryRow("select arla_compile($1::json)", string(b)).Scan(&res); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(key))
+	c := &compiled{
+		key:    key,
+		name:   "arla_pq_" + hex.EncodeToString(sum[:8]),
+		params: res.Params,
+		broken: res.SQL == nil,
+	}
+	if res.SQL != nil {
+		c.sql = *res.SQL
+	}
+	return p.persisted.put(c), nil
+}
+
+// values returns the statement parameters for q. Values are sent as text
+// so that postgres converts them to whatever type the statement expects.
+func (c *compiled) values(q *schema.Query) []interface{} {
+	values := make([]interface{}, len(c.params))
+	for i, param := range c.params {
+		var v interface{}
+		if param.Claim != "" {
+			v = q.Token[param.Claim]
+		} else if param.Arg > 0 && param.Arg <= len(q.Args) {
+			v = q.Args[param.Arg-1]
+		}
+		switch v := v.(type) {
+		case float64:
+			values[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			values[i] = v
+		}
+	}
+	return values
+}
+
+// queryPersisted runs the persisted query with id using its prepared
+// statement, falling back to arla_query if it cannot be prepared.
+func (p *postgres) queryPersisted(ctx context.Context, id string, q *schema.Query, w io.Writer, withTables bool) ([]string, error) {
+	text, ok := p.PersistedQuery(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown persisted query %s", id)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.prepare(conn, id, q)
+	if err != nil || c == nil {
+		p.release(conn)
+		if err != nil {
+			return nil, err
+		}
+		return p.adhoc(ctx, text, q, w, withTables)
+	}
+	defer p.release(conn)
+	var tables []string
+	err = p.runTx(ctx, conn, func(tx *pgx.Tx) error {
+		out := jsonbytes{w: w}
+		if err := tx.QueryRow(c.name, c.values(q)...).Scan(&out); err != nil {
+			return err
+		}
+		if withTables {
+			tables, err = tableNames(tx, readTables)
+		}
+		return err
+	})
+	return tables, err
+}
+
+// prepare returns the statement for the persisted query with id prepared on
+// conn. It returns nil if the query cannot be prepared and must be run with
+// arla_query instead. It must be called outside of a transaction.
+func (p *postgres) prepare(conn *pgx.Conn, id string, q *schema.Query) (*compiled, error) {
+	c, err := p.compile(conn, id, q)
+	if err != nil {
+		return nil, err
+	}
+	p.persisted.mu.Lock()
+	broken := c.broken
+	p.persisted.mu.Unlock()
+	if broken {
+		return nil, nil
+	}
+	// Prepare is a no-op if conn has already prepared the statement
+	if _, err := conn.Prepare(c.name, c.sql); err != nil {
+		fmt.Fprintf(p.log, "WARNING: persisted query %s cannot be prepared: %v\n", id, err)
+		p.persisted.mu.Lock()
+		c.broken = true
+		p.persisted.mu.Unlock()
+		return nil, nil
+	}
+	p.persisted.markPrepared(conn, c)
+	return c, nil
+}
+
+// acquire gets a connection for running persisted queries from the pool,
+// deallocating the statements that were evicted since it was last used.
+// Statements prepared during a request stay valid until the next acquire.
+func (p *postgres) acquire() (*pgx.Conn, error) {
+	conn, err := p.queryPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range p.persisted.stale(conn) {
+		if err := conn.Deallocate(name); err != nil {
+			p.release(conn)
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// release returns a connection from acquire to the pool
+func (p *postgres) release(conn *pgx.Conn) {
+	if !conn.IsAlive() {
+		p.persisted.forget(conn)
+	}
+	p.queryPool.Release(conn)
+}
+
+// adhoc runs the text of a persisted query with arla_query
+func (p *postgres) adhoc(ctx context.Context, text string, q *schema.Query, w io.Writer, withTables bool) ([]string, error) {
+	b, err := json.Marshal(&schema.Query{Query: text, Args: q.Args, Token: q.Token})
+	if err != nil {
+		return nil, err
+	}
+	return p.query(ctx, string(b), w, withTables)
+}
@@ -0,0 +1,53 @@
+package querystore
+
+import (
+	"container/list"
+	"fmt"
+	"testing"
+)
+import "github.com/jackc/pgx"
+
+func TestCompiledEviction(t *testing.T) {
+	ps := &persisted{
+		ll:       list.New(),
+		compiled: make(map[string]*list.Element),
+		prepared: make(map[*pgx.Conn]map[string]string),
+	}
+	conn := &pgx.Conn{}
+	for i := 0; i < maxCompiled+10; i++ {
+		c := ps.put(&compiled{
+			key:  fmt.Sprintf("q[%d]", i),
+			name: fmt.Sprintf("arla_pq_%d", i),
+		})
+		ps.markPrepared(conn, c)
+		if i == 0 {
+			// keep the first statement in use
+			continue
+		}
+		if _, ok := ps.get("q[0]"); !ok {
+			t.Fatalf("recently used statement was evicted after %d puts", i)
+		}
+	}
+	if n := ps.ll.Len(); n != maxCompiled {
+		t.Fatalf("expected %d compiled statements got %d", maxCompiled, n)
+	}
+	if len(ps.compiled) != maxCompiled {
+		t.Fatalf("expected %d keys got %d", maxCompiled, len(ps.compiled))
+	}
+	stale := ps.stale(conn)
+	if len(stale) != 10 {
+		t.Fatalf("expected 10 stale statements got %d: %v", len(stale), stale)
+	}
+	for _, name := range stale {
+		if name == "arla_pq_0" {
+			t.Fatal("recently used statement should not be stale")
+		}
+	}
+	if stale := ps.stale(conn); len(stale) != 0 {
+		t.Fatalf("stale statements should only be returned once got %v", stale)
+	}
+	ps.forget(conn)
+	if _, ok := ps.prepared[conn]; ok {
+		t.Fatal("forget should drop the connection")
+	}
+}
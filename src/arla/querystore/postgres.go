@@ -1,8 +1,10 @@
 package querystore
 
 import (
+	"arla/querycache"
 	"arla/schema"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -75,6 +77,9 @@ type postgres struct {
 	execMu sync.Mutex
 	// queryPool is used for reads
 	queryPool *pgx.ConnPool
+	// authPool is used for authentication so that slow password hashing
+	// cannot starve queries. It is queryPool if no slice was configured.
+	authPool *pgx.ConnPool
 	// options
 	cfg   *Config
 	pgcfg pgx.ConnConfig
@@ -90,6 +95,14 @@ type postgres struct {
 	info *schema.Info
 	// max number of db connections
 	maxConnections int
+	// number of connections reserved for authentication
+	authConnections int
+	// cache of shared query results
+	cache *querycache.Cache
+	// root property names of recent queries
+	roots *querycache.Cache
+	// allow-listed queries
+	persisted *persisted
 }
 
 func (p *postgres) SetLogLevel(level logLevel) {
@@ -117,56 +130,289 @@ func (p *postgres) Info() (*schema.Info, error) {
 	return p.info, nil
 }
 
-// Mutate applies a schema.Mutation to the data
-func (p *postgres) Mutate(m *schema.Mutation) error {
+// Mutate applies a schema.Mutation to the data and returns the JSON result
+// of the action, or nil if it has none. The mutation is cancelled if ctx is
+// done before it has been committed.
+func (p *postgres) Mutate(ctx context.Context, m *schema.Mutation) (json.RawMessage, error) {
 	if m.Name == "" {
-		return fmt.Errorf("invalid mutation name")
+		return nil, fmt.Errorf("invalid mutation name")
 	}
 	p.execMu.Lock()
 	defer p.execMu.Unlock()
-	m.Version = p.info.Version
+	// mutations from older clients keep their version to be transformed
+	if m.Version == 0 {
+		m.Version = p.info.Version
+	}
 	b, err := json.Marshal(m)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = p.execConn.Exec("select arla_exec($1::json)", string(b))
-	return err
+	var res bytes.Buffer
+	var tables []string
+	var tablesErr error
+	err = p.runTx(ctx, p.execConn, func(tx *pgx.Tx) error {
+		if err := tx.QueryRow("select arla_exec($1::json)", string(b)).Scan(&jsonbytes{w: &res}); err != nil {
+			return err
+		}
+		if p.cache.Enabled() {
+			tables, tablesErr = tableNames(tx, writtenTables)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tablesErr != nil {
+		p.cache.Purge()
+	} else {
+		p.cache.Invalidate(tables)
+	}
+	if res.Len() == 0 {
+		return nil, nil
+	}
+	return res.Bytes(), nil
+}
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// DryRun applies a schema.Mutation in a transaction that is always rolled
+// back and returns the action's result. Deferred triggers are fired before
+// the rollback so it fails in the same way the mutation would.
+func (p *postgres) DryRun(ctx context.Context, m *schema.Mutation) (json.RawMessage, error) {
+	if m.Name == "" {
+		return nil, fmt.Errorf("invalid mutation name")
+	}
+	// mutations from older clients keep their version to be transformed
+	if m.Version == 0 {
+		m.Version = p.info.Version
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var res bytes.Buffer
+	err = p.poolTx(ctx, p.queryPool, func(tx *pgx.Tx) error {
+		if err := tx.QueryRow("select arla_exec($1::json)", string(b)).Scan(&jsonbytes{w: &res}); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("set constraints all immediate"); err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if err != errDryRun {
+		return nil, err
+	}
+	if res.Len() == 0 {
+		return nil, nil
+	}
+	return res.Bytes(), nil
 }
 
-// Query executes an Arla query and writes the JSON response into w
-func (p *postgres) Query(q *schema.Query, w io.Writer) error {
-	out := jsonbytes{w: w}
-	b, err := json.Marshal(q)
+// Queries listing the tables touched by the current transaction
+const (
+	readTables    = "select relname from pg_stat_xact_user_tables where seq_scan + coalesce(idx_scan, 0) > 0"
+	writtenTables = "select relname from pg_stat_xact_user_tables where n_tup_ins + n_tup_upd + n_tup_del > 0"
+)
+
+// tableNames returns the names of the tables listed by sql
+func tableNames(tx *pgx.Tx, sql string) ([]string, error) {
+	rows, err := tx.Query(sql)
 	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// Query executes an Arla query and writes the JSON response into w.
+// Queries whose root properties are all marked as cacheable in the app
+// config are answered from the cache when possible. Queries with an ID run
+// the persisted query's prepared statement. The query is cancelled if ctx
+// is done before it completes.
+func (p *postgres) Query(ctx context.Context, q *schema.Query, w io.Writer) error {
+	run := func(w io.Writer, withTables bool) ([]string, error) {
+		if q.ID != "" {
+			return p.queryPersisted(ctx, q.ID, q, w, withTables)
+		}
+		b, err := json.Marshal(q)
+		if err != nil {
+			return nil, err
+		}
+		return p.query(ctx, string(b), w, withTables)
+	}
+	if q.ID != "" {
+		text, ok := p.PersistedQuery(q.ID)
+		if !ok {
+			return fmt.Errorf("unknown persisted query %s", q.ID)
+		}
+		q.Query = text
+	}
+	if !p.cache.Enabled() {
+		_, err := run(w, false)
 		return err
 	}
-	r := p.queryPool.QueryRow("select arla_query($1::json)", string(b))
-	if err := r.Scan(&out); err != nil {
+	roots, err := p.RootProperties(ctx, q.Query)
+	if err != nil {
+		// run the query anyway so that the caller gets its error
+		p.cache.Uncacheable()
+		_, err := run(w, false)
 		return err
 	}
-	return nil
+	claims, ok := querycache.Claims(p.info.Cache, roots, q.Token)
+	if !ok {
+		p.cache.Uncacheable()
+		_, err := run(w, false)
+		return err
+	}
+	key, err := querycache.Key(q.Query, q.Args, claims)
+	if err != nil {
+		return err
+	}
+	if res, ok := p.cache.Get(key); ok {
+		_, err := w.Write(res)
+		return err
+	}
+	gen := p.cache.Generation()
+	var res bytes.Buffer
+	tables, err := run(&res, true)
+	if err != nil {
+		return err
+	}
+	p.cache.Put(key, res.Bytes(), tables, gen)
+	_, err = w.Write(res.Bytes())
+	return err
+}
+
+// RootProperties returns the names of the root properties selected by an
+// Arla query, ignoring aliases. The query is parsed by arla_roots with the
+// same parser as arla_query so the names always match the properties that
+// are run. The names are remembered for each query text.
+func (p *postgres) RootProperties(ctx context.Context, query string) ([]string, error) {
+	var names []string
+	if b, ok := p.roots.Get(query); ok {
+		return names, json.Unmarshal(b, &names)
+	}
+	gen := p.roots.Generation()
+	b, err := json.Marshal(&schema.Query{Query: query})
+	if err != nil {
+		return nil, err
+	}
+	err = p.poolTx(ctx, p.queryPool, func(tx *pgx.Tx) error {
+		return tx.QueryRow("select arla_roots($1::json)", string(b)).Scan(&names)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if b, err = json.Marshal(names); err == nil {
+		p.roots.Put(query, b, nil, gen)
+	}
+	return names, nil
+}
+
+// query runs arla_query writing the result into w. If withTables is true
+// the names of the tables that were read to produce it are returned.
+func (p *postgres) query(ctx context.Context, q string, w io.Writer, withTables bool) (tables []string, err error) {
+	err = p.poolTx(ctx, p.queryPool, func(tx *pgx.Tx) error {
+		out := jsonbytes{w: w}
+		if err := tx.QueryRow("select arla_query($1::json)", q).Scan(&out); err != nil {
+			return err
+		}
+		if withTables {
+			tables, err = tableNames(tx, readTables)
+		}
+		return err
+	})
+	return tables, err
+}
+
+// CacheStats returns the query cache counters
+func (p *postgres) CacheStats() querycache.Stats {
+	return p.cache.Stats()
 }
 
 // Authenticate returns the token claims for the given json values
-func (p *postgres) Authenticate(vals string) (schema.Token, error) {
-	r := p.queryPool.QueryRow("select arla_authenticate($1::json)", vals)
-	var t schema.Token
-	if err := r.Scan(&t); err != nil {
+func (p *postgres) Authenticate(ctx context.Context, vals string) (t schema.Token, err error) {
+	err = p.poolTx(ctx, p.authPool, func(tx *pgx.Tx) error {
+		return tx.QueryRow("select arla_authenticate($1::json)", vals).Scan(&t)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return t, nil
 }
 
 // Register returns a mutation that will be used to create a user
-func (p *postgres) Register(vals string) (*schema.Mutation, error) {
-	r := p.queryPool.QueryRow("select arla_register($1::json)", vals)
+func (p *postgres) Register(ctx context.Context, vals string) (*schema.Mutation, error) {
 	var m schema.Mutation
-	if err := r.Scan(&m); err != nil {
+	err := p.poolTx(ctx, p.authPool, func(tx *pgx.Tx) error {
+		return tx.QueryRow("select arla_register($1::json)", vals).Scan(&m)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &m, nil
 }
 
+// APIKey returns the active api key matching hash or nil if no such key exists
+func (p *postgres) APIKey(hash string) (*schema.APIKey, error) {
+	r := p.queryPool.QueryRow("select arla_api_key($1)", hash)
+	var k *schema.APIKey
+	if err := r.Scan(&k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// APIKeys returns all api keys including revoked ones
+func (p *postgres) APIKeys() ([]*schema.APIKey, error) {
+	r := p.queryPool.QueryRow("select arla_api_keys()")
+	var keys []*schema.APIKey
+	if err := r.Scan(&keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// TOTP returns the two-factor state for subject or nil if it is not enabled
+func (p *postgres) TOTP(subject string) (*schema.TOTP, error) {
+	r := p.authPool.QueryRow("select arla_totp($1)", subject)
+	var t *schema.TOTP
+	if err := r.Scan(&t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Digest returns a digest of the contents of each table that does not
+// depend on the order of rows
+func (p *postgres) Digest() (map[string]string, error) {
+	var digest map[string]string
+	if err := p.queryPool.QueryRow("select arla_digest()").Scan(&digest); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// Divergences returns the tables that did not match a checkpoint when the
+// log was replayed
+func (p *postgres) Divergences() ([]*schema.Divergence, error) {
+	var divergences []*schema.Divergence
+	if err := p.queryPool.QueryRow("select arla_divergences()").Scan(&divergences); err != nil {
+		return nil, err
+	}
+	return divergences, nil
+}
+
 // Copy the config files into the data dir
 func (p *postgres) cpConfig(name string) (err error) {
 	dataDir := os.Getenv("PGDATA")
@@ -230,12 +476,22 @@ func (p *postgres) Start() (err error) {
 	if err != nil {
 		return
 	}
+	p.authPool = p.queryPool
+	if p.authConnections > 0 {
+		p.authPool, err = pgx.NewConnPool(pgx.ConnPoolConfig{
+			ConnConfig:     p.pgcfg,
+			MaxConnections: p.authConnections,
+		})
+		if err != nil {
+			return
+		}
+	}
 	// load app info
 	r := p.queryPool.QueryRow("select arla_info()")
 	if err := r.Scan(&p.info); err != nil {
 		return err
 	}
-	return nil
+	return p.loadQueries(p.cfg.QueriesDir)
 }
 
 func (p *postgres) NewWriter() (w io.WriteCloser, err error) {
@@ -251,7 +507,7 @@ func (p *postgres) spawn() (err error) {
 	p.cmd, err = p.command(
 		"postgres",
 		"-k", "/var/run/postgresql",
-		"-c", fmt.Sprintf("max_connections=%d", p.maxConnections+1),
+		"-c", fmt.Sprintf("max_connections=%d", p.maxConnections+p.authConnections+1),
 	)
 	if err != nil {
 		return err
@@ -24,11 +24,37 @@ CREATE OR REPLACE FUNCTION arla_replay(mutation json) RETURNS boolean AS $$
 	return plv8.arla.replay(mutation);
 $$ LANGUAGE "plv8";
 
+-- the time the mutation being executed was received. use instead of now()
+-- so that replaying the mutation log produces the same values.
+CREATE OR REPLACE FUNCTION arla_now() RETURNS timestamptz AS $$
+	return plv8.arla.now();
+$$ LANGUAGE "plv8";
+
+-- random() seeded by the mutation being executed
+CREATE OR REPLACE FUNCTION arla_random() RETURNS double precision AS $$
+	return plv8.arla.random();
+$$ LANGUAGE "plv8";
+
+-- gen_random_uuid() seeded by the mutation being executed
+CREATE OR REPLACE FUNCTION arla_uuid() RETURNS uuid AS $$
+	return plv8.arla.uuid();
+$$ LANGUAGE "plv8";
+
 -- use graphql to execute a query
 CREATE OR REPLACE FUNCTION arla_query(query json) RETURNS json AS $$
 	return JSON.stringify(plv8.arla.query(query));
 $$ LANGUAGE "plv8";
 
+-- list the root properties selected by a query
+CREATE OR REPLACE FUNCTION arla_roots(query json) RETURNS json AS $$
+	return JSON.stringify(plv8.arla.roots(query));
+$$ LANGUAGE "plv8";
+
+-- compile a persisted query into a statement that can be prepared
+CREATE OR REPLACE FUNCTION arla_compile(query json) RETURNS json AS $$
+	return JSON.stringify(plv8.arla.compile(query));
+$$ LANGUAGE "plv8";
+
 -- run the authentication func
 CREATE OR REPLACE FUNCTION arla_authenticate(vals json) RETURNS json AS $$
 	return JSON.stringify(plv8.arla.authenticate(vals));
@@ -43,6 +69,10 @@ $$ LANGUAGE "plv8";
 CREATE OR REPLACE FUNCTION arla_info() RETURNS json AS $$
 	return JSON.stringify({
 		version: plv8.arla.cfg.version,
-		mutations: Object.keys(plv8.arla.cfg.actions)
+		mutations: Object.keys(plv8.arla.cfg.actions),
+		rateLimits: plv8.arla.cfg.rateLimits || {},
+		cache: plv8.arla.cfg.cache || {},
+		timeouts: plv8.arla.cfg.timeouts || {},
+		queries: plv8.arla.cfg.queries || {}
 	});
 $$ LANGUAGE "plv8";
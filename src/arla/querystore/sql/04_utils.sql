@@ -1,10 +1,10 @@
 
--- since(x) === age(now(), x)
+-- since(x) === age(arla_now(), x)
 CREATE OR REPLACE FUNCTION since(t timestamptz) RETURNS interval AS $$
-	select age(now(), t);
+	select age(arla_now(), t);
 $$ LANGUAGE "sql" VOLATILE;
 
--- until(x) === age(x, now())
+-- until(x) === age(x, arla_now())
 CREATE OR REPLACE FUNCTION until(t timestamptz) RETURNS interval AS $$
-	select age(t, now());
+	select age(t, arla_now());
 $$ LANGUAGE "sql" VOLATILE;
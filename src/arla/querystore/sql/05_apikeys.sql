@@ -0,0 +1,31 @@
+-- api keys for server-to-server clients (only the hash of the key is stored)
+CREATE TABLE arla_api_key (
+	id uuid PRIMARY KEY,
+	hash text NOT NULL UNIQUE,
+	name text NOT NULL DEFAULT '',
+	claims json NOT NULL DEFAULT '{}',
+	actions json NOT NULL DEFAULT '[]',
+	ips json NOT NULL DEFAULT '[]',
+	created timestamptz NOT NULL,
+	revoked timestamptz
+);
+
+-- fetch an active api key by hash
+CREATE OR REPLACE FUNCTION arla_api_key(keyhash text) RETURNS json AS $$
+	select row_to_json(k) from (
+		select id, name, claims, actions, ips,
+			extract(epoch from created)::bigint as created
+		from arla_api_key
+		where hash = keyhash and revoked is null
+	) k;
+$$ LANGUAGE "sql" STABLE;
+
+-- list all api keys (without hashes)
+CREATE OR REPLACE FUNCTION arla_api_keys() RETURNS json AS $$
+	select coalesce(json_agg(k order by k.created), '[]'::json) from (
+		select id, name, claims, actions, ips,
+			extract(epoch from created)::bigint as created,
+			extract(epoch from revoked)::bigint as revoked
+		from arla_api_key
+	) k;
+$$ LANGUAGE "sql" STABLE;
@@ -0,0 +1,20 @@
+-- two-factor authentication secrets (encrypted) and recovery code hashes
+CREATE TABLE arla_totp (
+	subject text PRIMARY KEY,
+	secret text NOT NULL,
+	recovery json NOT NULL DEFAULT '[]',
+	enabled timestamptz NOT NULL,
+	-- the time step of the last accepted code, codes are single use
+	last_step bigint
+);
+
+-- fetch the 2fa state for a user
+CREATE OR REPLACE FUNCTION arla_totp(subj text) RETURNS json AS $$
+	select row_to_json(t) from (
+		select subject, secret, recovery,
+			extract(epoch from enabled)::bigint as enabled,
+			coalesce(last_step, 0) as last_step
+		from arla_totp
+		where subject = subj
+	) t;
+$$ LANGUAGE "sql" STABLE;
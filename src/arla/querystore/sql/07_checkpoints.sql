@@ -0,0 +1,22 @@
+-- tables whose contents did not match a checkpoint in the mutation log when
+-- it was replayed. only the first divergence of each table is recorded.
+CREATE TABLE arla_divergence (
+	tbl text PRIMARY KEY,
+	from_seq bigint NOT NULL,
+	to_seq bigint NOT NULL,
+	expected text,
+	actual text
+);
+
+-- digest each table's contents
+CREATE OR REPLACE FUNCTION arla_digest() RETURNS json AS $$
+	return JSON.stringify(plv8.arla.digest());
+$$ LANGUAGE "plv8";
+
+-- list the divergences found during replay
+CREATE OR REPLACE FUNCTION arla_divergences() RETURNS json AS $$
+	select coalesce(json_agg(d order by d.from_seq, d.tbl), '[]'::json) from (
+		select tbl as table, from_seq, to_seq, expected, actual
+		from arla_divergence
+	) d;
+$$ LANGUAGE "sql" STABLE;
@@ -36,7 +36,11 @@ func newPgWriter(p *postgres) (pgw *pgWriter, err error) {
 	return
 }
 
+// Close waits for psql to exit. Any cached query results are dropped as
+// the data may have changed.
 func (pgw *pgWriter) Close() error {
 	pgw.WriteCloser.Close()
-	return <-pgw.err
+	err := <-pgw.err
+	pgw.p.cache.Purge()
+	return err
 }
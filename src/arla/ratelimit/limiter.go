@@ -0,0 +1,134 @@
+// Package ratelimit implements in-memory token bucket rate limiting and
+// progressive lockouts keyed by arbitrary strings (IPs, usernames etc).
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a set of token buckets keyed by string. Each bucket holds
+// up to Burst tokens and refills at Rate tokens per second.
+type Limiter struct {
+	Rate  float64
+	Burst int
+	// Now returns the current time (replaceable for tests)
+	Now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// State is a snapshot of a single bucket
+type State struct {
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+}
+
+// NewLimiter creates a Limiter allowing rate requests per second with bursts
+// of up to burst requests. A rate of zero or less disables the limiter.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		Rate:    rate,
+		Burst:   burst,
+		Now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// PerMinute is a helper for creating a Limiter using requests per minute
+func PerMinute(n float64, burst int) *Limiter {
+	return NewLimiter(n/60, burst)
+}
+
+// Enabled returns false if the limiter allows everything
+func (l *Limiter) Enabled() bool {
+	return l != nil && l.Rate > 0
+}
+
+// Allow takes a token from the bucket for key. If no tokens are available
+// it returns false and the duration until the next token will be available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Now()
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		l.prune(now)
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	return false, wait
+}
+
+// refill returns the bucket for key topped up for the time elapsed since it
+// was last used. Must be called with mu held.
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+		return b
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(l.Burst), b.tokens+elapsed*l.Rate)
+		b.last = now
+	}
+	return b
+}
+
+// prune occasionally drops buckets that have refilled completely since
+// they are indistinguishable from a new bucket. Must be called with mu held.
+func (l *Limiter) prune(now time.Time) {
+	l.calls++
+	if l.calls < 1000 {
+		return
+	}
+	l.calls = 0
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// States returns a snapshot of all buckets that are not currently full
+func (l *Limiter) States() []State {
+	if !l.Enabled() {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Now()
+	states := make([]State, 0, len(l.buckets))
+	for k := range l.buckets {
+		b := l.refill(k, now)
+		if b.tokens >= float64(l.Burst) {
+			continue
+		}
+		states = append(states, State{
+			Key:    k,
+			Tokens: b.tokens,
+			Rate:   l.Rate,
+			Burst:  l.Burst,
+		})
+	}
+	return states
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Lockout tracks repeated failures (ie. bad passwords) per key. Once Threshold
+// consecutive failures have been recorded the key is locked for Duration, and
+// each further failure doubles the lock time up to MaxDuration.
+type Lockout struct {
+	Threshold   int
+	Duration    time.Duration
+	MaxDuration time.Duration
+	// Now returns the current time (replaceable for tests)
+	Now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*lockEntry
+	calls   int
+}
+
+type lockEntry struct {
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+	Last     time.Time `json:"last"`
+}
+
+// NewLockout creates a Lockout. A threshold of zero or less disables it.
+func NewLockout(threshold int, d, max time.Duration) *Lockout {
+	if max < d {
+		max = d
+	}
+	return &Lockout{
+		Threshold:   threshold,
+		Duration:    d,
+		MaxDuration: max,
+		Now:         time.Now,
+		entries:     make(map[string]*lockEntry),
+	}
+}
+
+// Enabled returns false if the lockout never locks anything
+func (l *Lockout) Enabled() bool {
+	return l != nil && l.Threshold > 0 && l.Duration > 0
+}
+
+// Locked returns how long key remains locked for (zero if not locked)
+func (l *Lockout) Locked(key string) time.Duration {
+	if !l.Enabled() {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	if wait := e.Until.Sub(l.Now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Fail records a failure for key and returns the lock duration if the
+// failure caused key to become locked.
+func (l *Lockout) Fail(key string) time.Duration {
+	if !l.Enabled() {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Now()
+	e, ok := l.entries[key]
+	if !ok {
+		e = &lockEntry{}
+		l.entries[key] = e
+	}
+	// forget old failures once a lock has long expired
+	if !e.Last.IsZero() && now.Sub(e.Last) > l.MaxDuration && now.After(e.Until) {
+		e.Failures = 0
+	}
+	e.Failures++
+	e.Last = now
+	l.prune(now)
+	if e.Failures < l.Threshold {
+		return 0
+	}
+	d := l.Duration
+	for i := l.Threshold; i < e.Failures && d < l.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > l.MaxDuration {
+		d = l.MaxDuration
+	}
+	e.Until = now.Add(d)
+	return d
+}
+
+// Reset forgets any failures for key (ie. after a successful login)
+func (l *Lockout) Reset(key string) {
+	if !l.Enabled() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// prune occasionally drops entries that are no longer locked and have not
+// failed recently. Must be called with mu held.
+func (l *Lockout) prune(now time.Time) {
+	l.calls++
+	if l.calls < 1000 {
+		return
+	}
+	l.calls = 0
+	for k, e := range l.entries {
+		if now.After(e.Until) && now.Sub(e.Last) > l.MaxDuration {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// Save writes the current lockout state as JSON to w
+func (l *Lockout) Save(w io.Writer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return json.NewEncoder(w).Encode(l.entries)
+}
+
+// Load replaces the current lockout state with JSON read from r
+func (l *Lockout) Load(r io.Reader) error {
+	entries := make(map[string]*lockEntry)
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = entries
+	return nil
+}
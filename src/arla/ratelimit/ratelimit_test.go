@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// clock is a fake time source
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.t
+}
+
+func (c *clock) Add(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newClock() *clock {
+	return &clock{t: time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func TestLimiterBurstThenRefill(t *testing.T) {
+	c := newClock()
+	l := NewLimiter(1, 3)
+	l.Now = c.Now
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("expected request %d to be allowed within burst", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("expected request to be limited after burst")
+	}
+	if wait != time.Second {
+		t.Fatalf("expected retry after 1s got %v", wait)
+	}
+	// other keys should be unaffected
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("expected other key to be allowed")
+	}
+	c.Add(time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("expected request to be allowed after refill")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("expected only a single token to have refilled")
+	}
+}
+
+func TestLimiterStates(t *testing.T) {
+	c := newClock()
+	l := NewLimiter(1, 2)
+	l.Now = c.Now
+	l.Allow("a")
+	l.Allow("b")
+	l.Allow("b")
+	c.Add(time.Second)
+	states := l.States()
+	if len(states) != 1 {
+		t.Fatalf("expected only non-full buckets in states got %v", states)
+	}
+	if states[0].Key != "b" || states[0].Tokens != 1 {
+		t.Fatalf("expected b to have 1 token got %v", states[0])
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l := NewLimiter(0, 1)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatal("expected disabled limiter to allow everything")
+		}
+	}
+}
+
+func TestLockoutProgressive(t *testing.T) {
+	c := newClock()
+	l := NewLockout(3, time.Minute, 10*time.Minute)
+	l.Now = c.Now
+	for i := 0; i < 2; i++ {
+		if d := l.Fail("bob"); d != 0 {
+			t.Fatalf("expected no lock before threshold got %v", d)
+		}
+	}
+	if d := l.Fail("bob"); d != time.Minute {
+		t.Fatalf("expected 1m lock at threshold got %v", d)
+	}
+	if d := l.Locked("bob"); d != time.Minute {
+		t.Fatalf("expected bob to be locked for 1m got %v", d)
+	}
+	if d := l.Locked("alice"); d != 0 {
+		t.Fatalf("expected alice to be unlocked got %v", d)
+	}
+	// each further failure doubles the lock
+	if d := l.Fail("bob"); d != 2*time.Minute {
+		t.Fatalf("expected 2m lock got %v", d)
+	}
+	if d := l.Fail("bob"); d != 4*time.Minute {
+		t.Fatalf("expected 4m lock got %v", d)
+	}
+	for i := 0; i < 5; i++ {
+		l.Fail("bob")
+	}
+	if d := l.Locked("bob"); d != 10*time.Minute {
+		t.Fatalf("expected lock to be capped at 10m got %v", d)
+	}
+	c.Add(10 * time.Minute)
+	if d := l.Locked("bob"); d != 0 {
+		t.Fatalf("expected lock to expire got %v", d)
+	}
+	// a success resets the count
+	l.Reset("bob")
+	if d := l.Fail("bob"); d != 0 {
+		t.Fatalf("expected reset to clear failures got %v", d)
+	}
+}
+
+func TestLockoutSaveLoad(t *testing.T) {
+	c := newClock()
+	l := NewLockout(1, time.Minute, time.Hour)
+	l.Now = c.Now
+	l.Fail("bob")
+	var buf bytes.Buffer
+	if err := l.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	l2 := NewLockout(1, time.Minute, time.Hour)
+	l2.Now = c.Now
+	if err := l2.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if d := l2.Locked("bob"); d != time.Minute {
+		t.Fatalf("expected loaded state to keep bob locked for 1m got %v", d)
+	}
+}
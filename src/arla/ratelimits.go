@@ -0,0 +1,74 @@
+package main
+
+import (
+	"arla/ratelimit"
+	"arla/schema"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// requestLimits holds the per-token and per-ip limiters for an endpoint
+type requestLimits struct {
+	token *ratelimit.Limiter
+	ip    *ratelimit.Limiter
+}
+
+// limitKey returns the key that the token is rate limited by. This is the
+// configured UserClaim or the client IP if the token does not have one.
+func (s *Server) limitKey(r *http.Request, t schema.Token) string {
+	if id, ok := t[s.cfg.UserClaim]; ok && id != nil {
+		return fmt.Sprint(id)
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// limitRequest takes a token from the per-ip and per-token buckets for the
+// named endpoint and returns an error if either of them is empty.
+func (s *Server) limitRequest(r *http.Request, t schema.Token, name string, l requestLimits) *Error {
+	ip := remoteIP(r)
+	if ok, d := l.ip.Allow(ip); !ok {
+		return rateLimitError(fmt.Errorf("%s rate limit exceeded for ip %s", name, ip), name+":ip", d)
+	}
+	key := s.limitKey(r, t)
+	if ok, d := l.token.Allow(key); !ok {
+		return rateLimitError(fmt.Errorf("%s rate limit exceeded for %s", name, key), name+":token", d)
+	}
+	return nil
+}
+
+// limitAction applies the rate limit for an exec of action. An action with
+// its own limit in the app config uses that instead of the exec limits,
+// except for dry runs which count against the exec limits so that they do
+// not use up the action's limit.
+func (s *Server) limitAction(r *http.Request, t schema.Token, action string, dryRun bool) *Error {
+	l, ok := s.actionLimits[action]
+	if !ok || dryRun {
+		return s.limitRequest(r, t, "exec", s.execLimits)
+	}
+	key := s.limitKey(r, t)
+	if ok, d := l.Allow(key); !ok {
+		return rateLimitError(fmt.Errorf("%s rate limit exceeded for %s", action, key), "action:"+action, d)
+	}
+	return nil
+}
+
+// rateLimitsHandler returns the state of every bucket that is currently
+// below its burst size, grouped by limit name.
+func (s *Server) rateLimitsHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	states := map[string][]ratelimit.State{
+		"auth:ip":       s.authIPLimit.States(),
+		"auth:username": s.authUserLimit.States(),
+		"exec:ip":       s.execLimits.ip.States(),
+		"exec:token":    s.execLimits.token.States(),
+		"query:ip":      s.queryLimits.ip.States(),
+		"query:token":   s.queryLimits.token.States(),
+	}
+	for name, l := range s.actionLimits {
+		states["action:"+name] = l.States()
+	}
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		return internalError(err)
+	}
+	return nil
+}
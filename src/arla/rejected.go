@@ -0,0 +1,82 @@
+package main
+
+import (
+	"arla/schema"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+import "github.com/jackc/pgx"
+
+// defaultRejectedLimit is the number of rejected mutations returned when a
+// query does not give a limit
+const defaultRejectedLimit = 100
+
+// reject records a mutation that failed in the rejected log. Only failures
+// reported by the action or its validations are recorded.
+func (s *Server) reject(m *schema.Mutation, e *Error) {
+	if _, ok := e.err.(pgx.PgError); !ok || s.rejected == nil {
+		return
+	}
+	r := *m
+	r.Status = schema.StatusRejected
+	r.Rejection = &schema.Rejection{
+		Error: e.Message,
+		Time:  time.Now().UTC(),
+	}
+	r.Rejection.User = s.subject(m.Token)
+	if err := s.rejected.Write(&r); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: failed to record rejected mutation: %v\n", err)
+	}
+}
+
+// rejectedQuery filters the rejected log
+type rejectedQuery struct {
+	logFilter
+	// Limit is the max number of the most recent matches to return
+	Limit int `json:"limit"`
+}
+
+// rejectedHandler returns the most recent rejected mutations matching the
+// filter in the request body, such as a user, action and time range
+func (s *Server) rejectedHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	var q rejectedQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		return userError(err)
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultRejectedLimit
+	}
+	q.UserClaim = s.cfg.UserClaim
+	if s.rejected == nil {
+		return tempError()
+	}
+	rejected := []*schema.Mutation{}
+	var seq int64
+	err := s.rejected.Scan(func(m *schema.Mutation) bool {
+		seq++
+		if !q.match(m, seq) {
+			return true
+		}
+		if len(rejected) == q.Limit {
+			rejected = rejected[1:]
+		}
+		rejected = append(rejected, m)
+		return true
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	err = json.NewEncoder(w).Encode(&struct {
+		Rejected []*schema.Mutation `json:"rejected"`
+	}{
+		Rejected: rejected,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
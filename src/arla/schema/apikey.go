@@ -0,0 +1,58 @@
+package schema
+
+import (
+	"net"
+	"strings"
+)
+
+// APIKey is a long-lived credential for server-to-server clients. Only a hash
+// of the key itself is ever stored. The Claims are used as the session Token
+// for any request authenticated with the key.
+type APIKey struct {
+	ID      UUID     `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Claims  Token    `json:"claims"`
+	Actions []string `json:"actions,omitempty"`
+	IPs     []string `json:"ips,omitempty"`
+	Created int64    `json:"created,omitempty"`
+	Revoked int64    `json:"revoked,omitempty"`
+}
+
+// AllowsAction returns true if the key is permitted to exec the named action.
+// An empty Actions list allows all actions.
+func (k *APIKey) AllowsAction(name string) bool {
+	if len(k.Actions) == 0 {
+		return true
+	}
+	for _, a := range k.Actions {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP returns true if the key may be used from the given address.
+// IPs entries may either be single addresses or CIDR ranges. An empty IPs
+// list allows all addresses.
+func (k *APIKey) AllowsIP(addr string) bool {
+	if len(k.IPs) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, s := range k.IPs {
+		if strings.Contains(s, "/") {
+			if _, n, err := net.ParseCIDR(s); err == nil && n.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if allowed := net.ParseIP(s); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,11 @@
 package schema
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"time"
 )
 
 // Mutation is an operation submitted to the application (most likely by a user)
@@ -16,6 +19,45 @@ type Mutation struct {
 	Name    string        `json:"name,omitempty"`
 	Args    []interface{} `json:"args,omitempty"`
 	Status  string        `json:"status,omitempty"`
+	// Batch holds the mutations of a BatchMutation
+	Batch []*Mutation `json:"batch,omitempty"`
+	// Rejection is set on mutations with StatusRejected
+	Rejection *Rejection `json:"rejection,omitempty"`
+	// Meta describes the request the mutation was received in. Actions
+	// only see it if they opt in.
+	Meta *Meta `json:"meta,omitempty"`
+	// Digest is the digest of each table for a CheckpointMutation
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// Meta is the envelope of request details logged with a mutation
+type Meta struct {
+	// Received is when the server received the mutation. It is also the
+	// current time while the mutation is executed or replayed.
+	Received time.Time `json:"received"`
+	// Seq is the position of the mutation in the log
+	Seq       int64  `json:"seq,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	// Version is the api version the client declared
+	Version int `json:"version,omitempty"`
+	// Seed seeds the random values generated while the mutation is
+	// executed so that replaying it produces the same values. It is a
+	// string of 128 bits in hex, or a 32 bit number in older logs.
+	Seed json.RawMessage `json:"seed,omitempty"`
+}
+
+// StatusRejected is the status of a mutation that failed. Rejected
+// mutations are kept in their own log and are never replayed.
+const StatusRejected = "rejected"
+
+// Rejection records why and when a mutation failed and who submitted it
+type Rejection struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+	// User is the id claim of the session that submitted the mutation
+	User string `json:"user,omitempty"`
 }
 
 // Query is the request format for AQL queries with arguments
@@ -23,6 +65,8 @@ type Query struct {
 	Token Token         `json:"token,omitempty"`
 	Query string        `json:"query,omitempty"`
 	Args  []interface{} `json:"args,omitempty"`
+	// ID names a persisted query to run instead of Query
+	ID string `json:"id,omitempty"`
 }
 
 // Arg is an argument for a mutation action.
@@ -49,6 +93,59 @@ type Service interface {
 
 // Info is the response of arla_info
 type Info struct {
-	Version   int      `json:"version"`
-	Mutations []string `json:"mutations"`
+	Version    int                    `json:"version"`
+	Mutations  []string               `json:"mutations"`
+	RateLimits map[string]RateLimit   `json:"rateLimits,omitempty"`
+	Cache      map[string]CachePolicy `json:"cache,omitempty"`
+	// Timeouts overrides the query timeout in milliseconds for queries
+	// selecting a root property
+	Timeouts map[string]int `json:"timeouts,omitempty"`
+	// Queries are the persisted queries declared in the app config
+	Queries map[string]string `json:"queries,omitempty"`
+}
+
+// RateLimit is a per-action override of the exec rate limit declared in
+// the app config. Execs of the action use it instead of the exec limits.
+// Rate is the number of requests per minute.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// CachePolicy marks a root query property as cacheable. In the app config
+// it is either `true` for results that are the same for every user, or
+// `{session: [claims...]}` for results that depend on some of the token's
+// claims, or `{session: true}` if they depend on the whole token.
+type CachePolicy struct {
+	// Claims are the token claims the result depends on
+	Claims []string `json:"claims,omitempty"`
+	// Session is true if the result depends on all of the token's claims
+	Session bool `json:"session,omitempty"`
+}
+
+// UnmarshalJSON accepts the forms allowed in the app config
+func (p *CachePolicy) UnmarshalJSON(b []byte) error {
+	var shared bool
+	if err := json.Unmarshal(b, &shared); err == nil {
+		if !shared {
+			return fmt.Errorf("cache policy must be true or {session: ...}")
+		}
+		*p = CachePolicy{}
+		return nil
+	}
+	var v struct {
+		Session json.RawMessage `json:"session"`
+		Claims  []string        `json:"claims"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*p = CachePolicy{Claims: v.Claims}
+	if len(v.Session) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(v.Session, &p.Session); err == nil {
+		return nil
+	}
+	return json.Unmarshal(v.Session, &p.Claims)
 }
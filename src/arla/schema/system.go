@@ -0,0 +1,50 @@
+package schema
+
+import "strings"
+
+// SystemMutationPrefix is the namespace reserved for mutations that are
+// generated by the server itself (rather than by user defined actions).
+// Mutations with this prefix can never be submitted via /exec.
+const SystemMutationPrefix = "arla."
+
+// Names of the built-in system mutations
+const (
+	CreateAPIKeyMutation        = SystemMutationPrefix + "createApiKey"
+	RevokeAPIKeyMutation        = SystemMutationPrefix + "revokeApiKey"
+	EnableTOTPMutation          = SystemMutationPrefix + "enableTotp"
+	DisableTOTPMutation         = SystemMutationPrefix + "disableTotp"
+	UseTOTPRecoveryCodeMutation = SystemMutationPrefix + "useTotpRecoveryCode"
+	UseTOTPCodeMutation         = SystemMutationPrefix + "useTotpCode"
+	// BatchMutation applies the mutations in its Batch atomically
+	BatchMutation = SystemMutationPrefix + "batch"
+	// CheckpointMutation is a log record holding a Digest of the state
+	// after the mutations before it. It is verified rather than executed
+	// when the log is replayed.
+	CheckpointMutation = SystemMutationPrefix + "checkpoint"
+)
+
+// Divergence is a table whose replayed contents did not match a checkpoint.
+// The mutations from FromSeq to ToSeq caused the difference.
+type Divergence struct {
+	Table    string `json:"table"`
+	FromSeq  int64  `json:"from_seq"`
+	ToSeq    int64  `json:"to_seq"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// IsSystemMutation returns true if name is reserved for server generated mutations
+func IsSystemMutation(name string) bool {
+	return strings.HasPrefix(name, SystemMutationPrefix)
+}
+
+// TOTP is the two-factor authentication state for a user. The Secret is
+// encrypted and Recovery holds hashes of the unused recovery codes.
+type TOTP struct {
+	Subject  string   `json:"subject"`
+	Secret   string   `json:"secret"`
+	Recovery []string `json:"recovery"`
+	Enabled  int64    `json:"enabled"`
+	// LastStep is the time step of the last code accepted
+	LastStep int64 `json:"last_step"`
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"arla/schema"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CSRFHeader is the request header that must echo the CSRF cookie for
+// state changing requests authenticated via a session cookie.
+const CSRFHeader = "X-CSRF-Token"
+
+// csrfCookieName is the name of the (script readable) CSRF cookie
+const csrfCookieName = "arla_csrf"
+
+// newCSRFToken generates a random CSRF token
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sessionCookie returns a cookie with the common session attributes set
+func (s *Server) sessionCookie(name, value string, exp time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  exp,
+		Secure:   !s.cfg.CookieInsecure,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// cookieSessionParam returns true if the client logging in asked for its
+// access token as a session cookie with ?session=cookie. Other clients
+// always get the token in the response.
+func (s *Server) cookieSessionParam(r *http.Request) (bool, *Error) {
+	switch v := r.URL.Query().Get("session"); v {
+	case "":
+		return false, nil
+	case "cookie":
+		if !s.cfg.CookieSessions {
+			return false, userError(fmt.Errorf("cookie sessions are not enabled"))
+		}
+		return true, nil
+	default:
+		return false, userError(fmt.Errorf("invalid session value %q", v))
+	}
+}
+
+// startSession sets the access token as an HttpOnly cookie along with a CSRF
+// cookie. The CSRF token is also returned in the response body so that the
+// client can send it back in the X-CSRF-Token header.
+func (s *Server) startSession(w http.ResponseWriter, accessToken string, exp time.Time) *Error {
+	csrf, err := newCSRFToken()
+	if err != nil {
+		return internalError(err)
+	}
+	session := s.sessionCookie(s.cfg.CookieName, accessToken, exp)
+	session.HttpOnly = true
+	http.SetCookie(w, session)
+	http.SetCookie(w, s.sessionCookie(csrfCookieName, csrf, exp))
+	err = json.NewEncoder(w).Encode(&struct {
+		CSRFToken string `json:"csrf_token"`
+	}{
+		CSRFToken: csrf,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// usedSessionCookie returns true if r was authenticated via the session cookie
+func usedSessionCookie(r *http.Request) bool {
+	ok, _ := r.Context().Value(sessionCookieContextKey).(bool)
+	return ok
+}
+
+// wrapCSRFHandler ensures that requests authenticated by a session cookie
+// carry a CSRF header that matches the CSRF cookie (double-submit). Requests
+// using an Authorization header are unaffected as browsers never add them
+// automatically.
+func (s *Server) wrapCSRFHandler(fn AuthenticatedHandlerFunc) AuthenticatedHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+		if !usedSessionCookie(r) {
+			return fn(w, r, t)
+		}
+		c, err := r.Cookie(csrfCookieName)
+		if err != nil {
+			return forbiddenError(fmt.Errorf("missing csrf cookie"))
+		}
+		h := r.Header.Get(CSRFHeader)
+		if h == "" || subtle.ConstantTimeCompare([]byte(h), []byte(c.Value)) != 1 {
+			return forbiddenError(fmt.Errorf("invalid csrf token"))
+		}
+		return fn(w, r, t)
+	}
+}
+
+// logoutHandler expires the session and CSRF cookies
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	expired := time.Unix(0, 0)
+	session := s.sessionCookie(s.cfg.CookieName, "", expired)
+	session.HttpOnly = true
+	session.MaxAge = -1
+	http.SetCookie(w, session)
+	csrf := s.sessionCookie(csrfCookieName, "", expired)
+	csrf.MaxAge = -1
+	http.SetCookie(w, csrf)
+	err := json.NewEncoder(w).Encode(&struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
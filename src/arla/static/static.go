@@ -0,0 +1,221 @@
+// Package static serves the files of a client app. It adds strong ETags,
+// long lived caching for fingerprinted assets, precompressed variants and
+// an optional fallback to index.html for client-side routing.
+package static
+
+import (
+	"arla/compress"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache-Control values
+const (
+	// Immutable is used for fingerprinted assets that never change
+	Immutable = "public, max-age=31536000, immutable"
+	// Revalidate is used for everything else so that clients always check
+	// the ETag before using a cached copy
+	Revalidate = "no-cache"
+)
+
+// fingerprinted matches names containing a content hash such as
+// app.3f2a9c1b.js or app-3f2a9c1bd0.css
+var fingerprinted = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^/]+$`)
+
+// encodings are the precompressed variants in order of preference
+var encodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// Handler serves files from Dir
+type Handler struct {
+	// Dir is the directory files are served from. If empty nothing is served.
+	Dir string
+	// SPA serves index.html for unknown paths that look like page navigations
+	SPA bool
+	// Config returns a value that is injected into index.html as
+	// window.ARLA_CONFIG. If nil index.html is served unmodified.
+	Config func() interface{}
+
+	mu    sync.Mutex
+	etags map[string]etag
+}
+
+// etag is a memoized ETag for a file at a particular modification time
+type etag struct {
+	modtime time.Time
+	size    int64
+	value   string
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Dir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(name, "/") || name == "/" {
+		name = path.Join(name, "index.html")
+	}
+	fi, err := os.Stat(h.filename(name))
+	if err == nil && fi.IsDir() {
+		name = path.Join(name, "index.html")
+		fi, err = os.Stat(h.filename(name))
+	}
+	if err != nil {
+		if !h.SPA || !isNavigation(r, name) {
+			http.NotFound(w, r)
+			return
+		}
+		name = "/index.html"
+		if fi, err = os.Stat(h.filename(name)); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if path.Base(name) == "index.html" && h.Config != nil {
+		h.serveIndex(w, r, name)
+		return
+	}
+	h.serveFile(w, r, name, fi)
+}
+
+// filename converts a clean url path into a path within Dir
+func (h *Handler) filename(name string) string {
+	return filepath.Join(h.Dir, filepath.FromSlash(name))
+}
+
+// serveFile serves the file or its best precompressed variant
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, name string, fi os.FileInfo) {
+	if fingerprinted.MatchString(name) {
+		w.Header().Set("Cache-Control", Immutable)
+	} else {
+		w.Header().Set("Cache-Control", Revalidate)
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	filename := h.filename(name)
+	w.Header().Add("Vary", "Accept-Encoding")
+	for _, enc := range encodings {
+		if !compress.Accepts(r, enc.name) {
+			continue
+		}
+		cfi, err := os.Stat(filename + enc.ext)
+		if err != nil || cfi.IsDir() {
+			continue
+		}
+		w.Header().Set("Content-Encoding", enc.name)
+		filename, fi = filename+enc.ext, cfi
+		break
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	tag, err := h.etag(filename, fi, f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", tag)
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// serveIndex serves index.html with the runtime config injected
+func (h *Handler) serveIndex(w http.ResponseWriter, r *http.Request, name string) {
+	b, err := ioutil.ReadFile(h.filename(name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	cfg, err := json.Marshal(h.Config())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b = Inject(b, cfg)
+	sum := sha256.Sum256(b)
+	w.Header().Set("Cache-Control", Revalidate)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", strconv.Quote(hex.EncodeToString(sum[:16])))
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+}
+
+// Inject adds a script setting window.ARLA_CONFIG before the closing head
+// tag of the html document (or at the start if there is no head). The JSON
+// encoder escapes <, > and & so cfg cannot close the script element.
+func Inject(html, cfg []byte) []byte {
+	script := []byte("<script>window.ARLA_CONFIG = " + string(cfg) + ";</script>")
+	i := bytes.Index(bytes.ToLower(html), []byte("</head>"))
+	if i < 0 {
+		return append(script, html...)
+	}
+	out := make([]byte, 0, len(html)+len(script))
+	out = append(out, html[:i]...)
+	out = append(out, script...)
+	return append(out, html[i:]...)
+}
+
+// etag returns the strong ETag of the file, hashing its content only when
+// it has changed since the last request.
+func (h *Handler) etag(filename string, fi os.FileInfo, f io.ReadSeeker) (string, error) {
+	h.mu.Lock()
+	cached, ok := h.etags[filename]
+	h.mu.Unlock()
+	if ok && cached.modtime.Equal(fi.ModTime()) && cached.size == fi.Size() {
+		return cached.value, nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	value := strconv.Quote(hex.EncodeToString(hash.Sum(nil)[:16]))
+	h.mu.Lock()
+	if h.etags == nil {
+		h.etags = make(map[string]etag)
+	}
+	h.etags[filename] = etag{modtime: fi.ModTime(), size: fi.Size(), value: value}
+	h.mu.Unlock()
+	return value, nil
+}
+
+// isNavigation returns true if the request looks like a browser loading a
+// page rather than fetching an asset or calling the API
+func isNavigation(r *http.Request, name string) bool {
+	if path.Ext(name) != "" {
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return accept == "" || strings.Contains(accept, "text/html") || strings.Contains(accept, "*/*")
+}
@@ -0,0 +1,156 @@
+package static
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setup creates a public dir containing the given files
+func setup(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "arlastatic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func get(h http.Handler, url string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestETag(t *testing.T) {
+	dir := setup(t, map[string]string{
+		"app.js":          "console.log(1)",
+		"app.3f2a9c1b.js": "console.log(2)",
+	})
+	defer os.RemoveAll(dir)
+	h := &Handler{Dir: dir}
+	w := get(h, "/app.js", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "console.log(1)" {
+		t.Fatalf("expected app.js to be served got %d %q", w.Code, w.Body.String())
+	}
+	tag := w.Header().Get("ETag")
+	if tag == "" || strings.HasPrefix(tag, "W/") {
+		t.Fatalf("expected strong etag got %q", tag)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != Revalidate {
+		t.Fatalf("expected unfingerprinted file to be revalidated got %q", cc)
+	}
+	w = get(h, "/app.js", map[string]string{"If-None-Match": tag})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected matching etag to return 304 got %d", w.Code)
+	}
+	w = get(h, "/app.3f2a9c1b.js", nil)
+	if cc := w.Header().Get("Cache-Control"); cc != Immutable {
+		t.Fatalf("expected fingerprinted file to be immutable got %q", cc)
+	}
+	if w.Header().Get("ETag") == tag {
+		t.Fatal("expected different content to have a different etag")
+	}
+}
+
+func TestPrecompressed(t *testing.T) {
+	dir := setup(t, map[string]string{
+		"app.js":    "plain",
+		"app.js.gz": "gzipped",
+		"app.js.br": "brotli",
+	})
+	defer os.RemoveAll(dir)
+	h := &Handler{Dir: dir}
+	for _, tc := range []struct {
+		accept   string
+		encoding string
+		body     string
+	}{
+		{"", "", "plain"},
+		{"gzip, deflate", "gzip", "gzipped"},
+		{"gzip, br", "br", "brotli"},
+		{"br;q=0, gzip", "gzip", "gzipped"},
+	} {
+		w := get(h, "/app.js", map[string]string{"Accept-Encoding": tc.accept})
+		if w.Body.String() != tc.body || w.Header().Get("Content-Encoding") != tc.encoding {
+			t.Fatalf("Accept-Encoding %q: expected %q (%s) got %q (%s)", tc.accept, tc.body, tc.encoding, w.Body.String(), w.Header().Get("Content-Encoding"))
+		}
+		if !strings.Contains(w.Header().Get("Content-Type"), "javascript") {
+			t.Fatalf("expected content type of the original file got %q", w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatal("expected Vary: Accept-Encoding")
+		}
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+	dir := setup(t, map[string]string{
+		"index.html": "<html><head></head><body>app</body></html>",
+	})
+	defer os.RemoveAll(dir)
+	h := &Handler{Dir: dir}
+	if w := get(h, "/users/1", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without SPA fallback got %d", w.Code)
+	}
+	h.SPA = true
+	w := get(h, "/users/1", map[string]string{"Accept": "text/html"})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "app") {
+		t.Fatalf("expected deep link to serve index.html got %d", w.Code)
+	}
+	if w := get(h, "/missing.js", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected missing asset to 404 got %d", w.Code)
+	}
+	if w := get(h, "/users/1", map[string]string{"Accept": "application/json"}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected non-navigation request to 404 got %d", w.Code)
+	}
+	if w := get(h, "/../../etc/passwd", nil); strings.Contains(w.Body.String(), "root:") {
+		t.Fatal("expected paths outside dir to not be served")
+	}
+}
+
+func TestInjectConfig(t *testing.T) {
+	dir := setup(t, map[string]string{
+		"index.html": "<html><head><title>x</title></head><body></body></html>",
+	})
+	defer os.RemoveAll(dir)
+	version := 1
+	h := &Handler{Dir: dir, SPA: true, Config: func() interface{} {
+		return map[string]interface{}{"apiVersion": version, "x": "</script>"}
+	}}
+	w := get(h, "/", nil)
+	body := w.Body.String()
+	if !strings.Contains(body, `<script>window.ARLA_CONFIG = {"apiVersion":1,`) {
+		t.Fatalf("expected config to be injected got %s", body)
+	}
+	if strings.Count(body, "</script>") != 1 {
+		t.Fatalf("expected injected values to be escaped got %s", body)
+	}
+	if !strings.Contains(body, "</script></head>") {
+		t.Fatalf("expected config to be injected into head got %s", body)
+	}
+	tag := w.Header().Get("ETag")
+	if w := get(h, "/", map[string]string{"If-None-Match": tag}); w.Code != http.StatusNotModified {
+		t.Fatalf("expected unchanged index to return 304 got %d", w.Code)
+	}
+	version = 2
+	if w := get(h, "/page", map[string]string{"If-None-Match": tag}); w.Code != http.StatusOK {
+		t.Fatalf("expected changed config to change the etag got %d", w.Code)
+	}
+}
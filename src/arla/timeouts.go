@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type timeoutContextKey struct{}
+
+// millis converts a duration in milliseconds from the config
+func millis(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// withTimeout returns the request's context limited to d. The context is
+// also cancelled if the client goes away. A zero duration has no limit.
+func withTimeout(r *http.Request, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	ctx := context.WithValue(r.Context(), timeoutContextKey{}, d)
+	return context.WithTimeout(ctx, d)
+}
+
+// queryTimeout returns the time allowed for query and the root property
+// that limit belongs to. Each root property is allowed the --query-timeout
+// default unless the app config's timeouts override it, and the query as a
+// whole gets the smallest limit of the properties it selects. The query is
+// only parsed if the app config has timeouts, and an error is returned if
+// it cannot be.
+func (s *Server) queryTimeout(r *http.Request, query string) (time.Duration, string, error) {
+	def := millis(s.cfg.QueryTimeout)
+	if s.info == nil || len(s.info.Timeouts) == 0 {
+		return def, "", nil
+	}
+	roots, err := s.qs.RootProperties(r.Context(), query)
+	if err != nil {
+		return def, "", err
+	}
+	var d time.Duration
+	var property []string
+	for _, name := range roots {
+		limit := def
+		if ms, ok := s.info.Timeouts[name]; ok {
+			limit = millis(ms)
+		}
+		switch {
+		case limit <= 0:
+			continue
+		case d <= 0 || limit < d:
+			d, property = limit, []string{name}
+		case limit == d:
+			property = append(property, name)
+		}
+	}
+	if len(roots) == 0 {
+		return def, "", nil
+	}
+	return d, strings.Join(property, ","), nil
+}
+
+// contextError returns a timeout naming property if ctx is done. It is used
+// to explain the error of a call that was given ctx.
+func contextError(ctx context.Context, property string) *Error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	d, _ := ctx.Value(timeoutContextKey{}).(time.Duration)
+	return timeoutError(err, property, d)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"arla/acme"
+	"arla/certs"
+	"arla/listen"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// tlsEnabled returns true if the main listener serves https
+func (s *Server) tlsEnabled() bool {
+	return s.cfg.TLSCert != "" || s.cfg.TLSKey != "" || len(s.cfg.ACMEDomains) > 0
+}
+
+// startTLS loads the certificates for the main listener either from files
+// or from the ACME cache. It returns nil if TLS is not enabled.
+func (s *Server) startTLS() (*tls.Config, error) {
+	if !s.tlsEnabled() {
+		if s.cfg.RedirectAddr != "" {
+			return nil, errors.New("redirect-addr requires tls-cert/tls-key or acme-domain")
+		}
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(s.cfg.ACMEDomains) > 0 {
+		if s.cfg.TLSCert != "" || s.cfg.TLSKey != "" {
+			return nil, errors.New("acme-domain cannot be used with tls-cert/tls-key")
+		}
+		if s.cfg.RedirectAddr == "" {
+			return nil, errors.New("acme-domain requires redirect-addr to answer http-01 challenges")
+		}
+		m := &acme.Manager{
+			DirectoryURL: s.cfg.ACMEDirectory,
+			Email:        s.cfg.ACMEEmail,
+			Domains:      s.cfg.ACMEDomains,
+			CacheDir:     filepath.Join(s.cfg.DataDir, "acme"),
+			RenewBefore:  time.Duration(s.cfg.ACMERenewBefore) * 24 * time.Hour,
+		}
+		if err := m.Load(); err != nil {
+			return nil, err
+		}
+		s.acme = m
+		cfg.GetCertificate = m.GetCertificate
+	} else {
+		r, err := certs.NewReloader(s.cfg.TLSCert, s.cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = r
+		cfg.GetCertificate = r.GetCertificate
+	}
+	s.tlsStop = make(chan struct{})
+	return cfg, nil
+}
+
+// watchCerts reloads certificates on SIGHUP or when the certificate files
+// change, and keeps ACME certificates renewed.
+func (s *Server) watchCerts(stop <-chan struct{}) {
+	if s.acme != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.acme.Run(stop, func(err error) {
+				fmt.Println("failed to obtain certificate:", err)
+			})
+		}()
+	}
+	var tick <-chan time.Time
+	if s.certs != nil && s.cfg.TLSReloadInterval > 0 {
+		ticker := time.NewTicker(time.Duration(s.cfg.TLSReloadInterval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			fmt.Println("reloading certificates")
+			s.reloadCerts()
+		case <-tick:
+			if s.certs.Changed() {
+				fmt.Println("certificate files changed, reloading")
+				s.reloadCerts()
+			}
+		}
+	}
+}
+
+// reloadCerts rereads certificates from disk. The current certificate
+// continues to be served if the new one cannot be loaded.
+func (s *Server) reloadCerts() {
+	var err error
+	if s.certs != nil {
+		err = s.certs.Reload()
+	} else if s.acme != nil {
+		err = s.acme.Load()
+	}
+	if err != nil {
+		fmt.Println("failed to reload certificates:", err)
+	}
+}
+
+// configureTLS enables https and HTTP/2 on the server
+func configureTLS(srv *http.Server, cfg *tls.Config) error {
+	srv.TLSConfig = cfg
+	return http2.ConfigureServer(srv, nil)
+}
+
+// redirectHandler sends plain http requests to the same URL on the https
+// listener. Methods other than GET and HEAD use 308 so that the body is
+// resent.
+func (s *Server) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port := s.httpsPort(); port != "" && port != "443" && port != "https" {
+		host = net.JoinHostPort(host, port)
+	}
+	code := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
+
+// httpsPort returns the port of the first tcp listener
+func (s *Server) httpsPort() string {
+	for _, addr := range s.cfg.ListenAddr {
+		if !listen.IsTCP(addr) {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			return port
+		}
+	}
+	return ""
+}
+
+// redirectMux serves the redirect listener, answering ACME challenges
+// before redirecting everything else to https.
+func (s *Server) redirectMux() http.Handler {
+	var h http.Handler = http.HandlerFunc(s.redirectHandler)
+	if s.acme != nil {
+		h = s.acme.HTTPHandler(h)
+	}
+	return h
+}
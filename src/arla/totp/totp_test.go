@@ -0,0 +1,149 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// base32 of the RFC 6238 SHA1 test key "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 appendix B vectors (truncated to 6 digits)
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range rfcVectors {
+		code, err := Code(rfcSecret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != v.code {
+			t.Fatalf("expected code at %d to be %s got %s", v.unix, v.code, code)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	if !Verify(rfcSecret, "005924", now) {
+		t.Fatal("expected current code to verify")
+	}
+	// allow a single period of clock drift
+	if !Verify(rfcSecret, "005924", now.Add(Period)) {
+		t.Fatal("expected previous period's code to verify")
+	}
+	if !Verify(rfcSecret, "005924", now.Add(-Period)) {
+		t.Fatal("expected next period's code to verify")
+	}
+	if Verify(rfcSecret, "005924", now.Add(3*Period)) {
+		t.Fatal("expected old code to be rejected")
+	}
+	if Verify(rfcSecret, "000000", now) {
+		t.Fatal("expected wrong code to be rejected")
+	}
+	if Verify(rfcSecret, "", now) {
+		t.Fatal("expected empty code to be rejected")
+	}
+}
+
+func TestVerifyAfter(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	last, ok := VerifyAfter(rfcSecret, "005924", now, 0)
+	if !ok {
+		t.Fatal("expected current code to verify")
+	}
+	// the same code must not be accepted again, even in the next period
+	if _, ok := VerifyAfter(rfcSecret, "005924", now, last); ok {
+		t.Fatal("expected used code to be rejected")
+	}
+	if _, ok := VerifyAfter(rfcSecret, "005924", now.Add(Period), last); ok {
+		t.Fatal("expected used code to be rejected within the skew")
+	}
+	next, err := Code(rfcSecret, now.Add(Period))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step, ok := VerifyAfter(rfcSecret, next, now.Add(Period), last); !ok || step != last+1 {
+		t.Fatalf("expected next period's code to verify at step %d got %d (%v)", last+1, step, ok)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1444000000, 0)
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Verify(secret, code, now) {
+		t.Fatal("expected generated secret to round trip")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Arla App", "alice", rfcSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Arla%20App:alice?") {
+		t.Fatalf("unexpected uri label: %s", uri)
+	}
+	if !strings.Contains(uri, "secret="+rfcSecret) {
+		t.Fatalf("expected uri to contain secret: %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("expected 10 codes got %d", len(codes))
+	}
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 9 || c[4] != '-' {
+			t.Fatalf("expected code in form xxxx-xxxx got %s", c)
+		}
+		h := HashRecoveryCode(c)
+		if seen[h] {
+			t.Fatalf("duplicate recovery code %s", c)
+		}
+		seen[h] = true
+		// normalization
+		if HashRecoveryCode(strings.ToUpper(strings.Replace(c, "-", "", 1))) != h {
+			t.Fatalf("expected hash to ignore case and dashes for %s", c)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	sealed, err := Seal("mysecret", rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, rfcSecret) {
+		t.Fatal("expected sealed secret to not contain plaintext")
+	}
+	secret, err := Open("mysecret", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != rfcSecret {
+		t.Fatalf("expected %s got %s", rfcSecret, secret)
+	}
+	if _, err := Open("wrongsecret", sealed); err == nil {
+		t.Fatal("expected open with wrong passphrase to fail")
+	}
+}
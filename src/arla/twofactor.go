@@ -0,0 +1,372 @@
+package main
+
+import (
+	"arla/schema"
+	"arla/totp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Token purposes for short-lived tokens that must never be accepted as
+// access tokens. Each purpose is signed with a different key.
+const (
+	totpChallengePurpose = "totp-challenge"
+	totpEnrollPurpose    = "totp-enroll"
+)
+
+const (
+	// totpChallengeTTL is how long a user has to enter their code after login
+	totpChallengeTTL = 5 * time.Minute
+	// totpEnrollTTL is how long a user has to confirm enrollment
+	totpEnrollTTL = 10 * time.Minute
+	// totpRecoveryCodes is the number of recovery codes issued on enrollment
+	totpRecoveryCodes = 10
+)
+
+// purposeKey derives the signing key for a purpose token
+func (s *Server) purposeKey(purpose string) []byte {
+	return []byte(s.cfg.Secret + ":" + purpose)
+}
+
+// signPurposeToken returns a short-lived token that can only be verified
+// with parsePurposeToken for the same purpose.
+func (s *Server) signPurposeToken(purpose string, claims map[string]interface{}, ttl time.Duration) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	for k, v := range claims {
+		token.Claims[k] = v
+	}
+	token.Claims["purpose"] = purpose
+	token.Claims["exp"] = time.Now().Add(ttl).Unix()
+	return token.SignedString(s.purposeKey(purpose))
+}
+
+// parsePurposeToken verifies a token created by signPurposeToken
+func (s *Server) parsePurposeToken(purpose, tokenString string) (map[string]interface{}, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.purposeKey(purpose), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || token.Claims["purpose"] != purpose {
+		return nil, fmt.Errorf("invalid %s token", purpose)
+	}
+	return token.Claims, nil
+}
+
+// subject returns the value of the UserClaim as a string or an empty
+// string if the token does not have one.
+func (s *Server) subject(t schema.Token) string {
+	if id, ok := t[s.cfg.UserClaim]; ok && id != nil {
+		return fmt.Sprint(id)
+	}
+	return ""
+}
+
+// challengeTOTP writes a challenge token instead of an access token if the
+// user has two-factor authentication enabled. It returns true if a challenge
+// was issued.
+func (s *Server) challengeTOTP(w http.ResponseWriter, claims schema.Token) (bool, *Error) {
+	sub := s.subject(claims)
+	if sub == "" {
+		return false, nil
+	}
+	state, err := s.qs.TOTP(sub)
+	if err != nil {
+		return false, internalError(err)
+	}
+	if state == nil {
+		return false, nil
+	}
+	challenge, err := s.signPurposeToken(totpChallengePurpose, map[string]interface{}{
+		"sub":    sub,
+		"claims": claims,
+	}, totpChallengeTTL)
+	if err != nil {
+		return false, internalError(err)
+	}
+	err = json.NewEncoder(w).Encode(&struct {
+		ChallengeToken string `json:"challenge_token"`
+		TOTPRequired   bool   `json:"totp_required"`
+	}{
+		ChallengeToken: challenge,
+		TOTPRequired:   true,
+	})
+	if err != nil {
+		return true, internalError(err)
+	}
+	return true, nil
+}
+
+// verifyTOTP checks either the code or a recovery code against the user's
+// two-factor state. Used recovery codes are removed via a mutation.
+func (s *Server) verifyTOTP(ctx context.Context, state *schema.TOTP, t schema.Token, code, recovery string) *Error {
+	secret, err := totp.Open(s.cfg.Secret, state.Secret)
+	if err != nil {
+		return internalError(err)
+	}
+	if code != "" {
+		step, ok := totp.VerifyAfter(secret, code, s.now(), state.LastStep)
+		if !ok {
+			return authError(fmt.Errorf("invalid two-factor code for %s", state.Subject))
+		}
+		// the step is only recorded if no other request has used it first
+		if err := s.commit(ctx, &schema.Mutation{
+			ID:    schema.TimeUUID(),
+			Token: t,
+			Name:  schema.UseTOTPCodeMutation,
+			Args:  []interface{}{state.Subject, step},
+		}); err != nil {
+			if err.code == http.StatusBadRequest {
+				return authError(fmt.Errorf("two-factor code for %s has already been used", state.Subject))
+			}
+			return err
+		}
+		return nil
+	}
+	if recovery != "" {
+		h := totp.HashRecoveryCode(recovery)
+		for _, stored := range state.Recovery {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(stored)) != 1 {
+				continue
+			}
+			// the code is only removed if no other request has used it first
+			if err := s.commit(ctx, &schema.Mutation{
+				ID:    schema.TimeUUID(),
+				Token: t,
+				Name:  schema.UseTOTPRecoveryCodeMutation,
+				Args:  []interface{}{state.Subject, h},
+			}); err != nil {
+				if err.code == http.StatusBadRequest {
+					return authError(fmt.Errorf("recovery code for %s has already been used", state.Subject))
+				}
+				return err
+			}
+			return nil
+		}
+		return authError(fmt.Errorf("invalid recovery code for %s", state.Subject))
+	}
+	return authError(errors.New("missing two-factor code"))
+}
+
+// totpAuthenticationHandler completes a two-step login by exchanging a
+// challenge token and a valid code (or recovery code) for an access token.
+func (s *Server) totpAuthenticationHandler(w http.ResponseWriter, r *http.Request) *Error {
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return userError(err)
+	}
+	ip := remoteIP(r)
+	if err := s.limitAuth(ip, ""); err != nil {
+		return err
+	}
+	challenge, err := s.parsePurposeToken(totpChallengePurpose, req.ChallengeToken)
+	if err != nil {
+		return authError(err)
+	}
+	sub, _ := challenge["sub"].(string)
+	vals, _ := challenge["claims"].(map[string]interface{})
+	if sub == "" || vals == nil {
+		return authError(errors.New("malformed challenge token"))
+	}
+	claims := schema.Token(vals)
+	if err := s.checkLockout(ip, "totp:"+sub); err != nil {
+		return err
+	}
+	if s.qs == nil {
+		return tempError()
+	}
+	release, e := s.admit(s.authGate, r)
+	if e != nil {
+		return e
+	}
+	state, err := s.qs.TOTP(sub)
+	release()
+	if err != nil {
+		return internalError(err)
+	}
+	// 2fa may have been disabled since the challenge was issued
+	if state != nil {
+		if err := s.verifyTOTP(r.Context(), state, claims, req.Code, req.RecoveryCode); err != nil {
+			if err.code == http.StatusUnauthorized {
+				s.authFailed(ip, "totp:"+sub)
+			}
+			return err
+		}
+	}
+	s.lockout.Reset(lockoutKey(ip, "totp:"+sub))
+	return s.issueToken(w, r, claims)
+}
+
+// totpEnrollHandler generates a new secret for the user. The secret is not
+// active until it is confirmed with a valid code via totpConfirmHandler.
+func (s *Server) totpEnrollHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	sub := s.subject(t)
+	if sub == "" {
+		return userError(fmt.Errorf("token has no %s claim", s.cfg.UserClaim))
+	}
+	if s.qs == nil {
+		return tempError()
+	}
+	release, e := s.admit(s.authGate, r)
+	if e != nil {
+		return e
+	}
+	state, err := s.qs.TOTP(sub)
+	release()
+	if err != nil {
+		return internalError(err)
+	}
+	if state != nil {
+		return userError(errors.New("two-factor authentication is already enabled"))
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return internalError(err)
+	}
+	enrollment, err := s.signPurposeToken(totpEnrollPurpose, map[string]interface{}{
+		"sub":    sub,
+		"secret": secret,
+	}, totpEnrollTTL)
+	if err != nil {
+		return internalError(err)
+	}
+	err = json.NewEncoder(w).Encode(&struct {
+		Secret          string `json:"secret"`
+		URI             string `json:"uri"`
+		EnrollmentToken string `json:"enrollment_token"`
+	}{
+		Secret:          secret,
+		URI:             totp.URI(s.cfg.TOTPIssuer, sub, secret),
+		EnrollmentToken: enrollment,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// totpConfirmHandler enables two-factor authentication once the user has
+// proved they can generate codes for the enrolled secret. The encrypted
+// secret and hashed recovery codes are recorded as a mutation.
+func (s *Server) totpConfirmHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	var req struct {
+		EnrollmentToken string `json:"enrollment_token"`
+		Code            string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return userError(err)
+	}
+	enrollment, err := s.parsePurposeToken(totpEnrollPurpose, req.EnrollmentToken)
+	if err != nil {
+		return userError(err)
+	}
+	sub := s.subject(t)
+	secret, _ := enrollment["secret"].(string)
+	if sub == "" || enrollment["sub"] != sub || secret == "" {
+		return userError(errors.New("enrollment token does not belong to this user"))
+	}
+	now := s.now()
+	step, ok := totp.VerifyAfter(secret, req.Code, now, 0)
+	if !ok {
+		return userError(errors.New("invalid two-factor code"))
+	}
+	codes, err := totp.GenerateRecoveryCodes(totpRecoveryCodes)
+	if err != nil {
+		return internalError(err)
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = totp.HashRecoveryCode(code)
+	}
+	sealed, err := totp.Seal(s.cfg.Secret, secret)
+	if err != nil {
+		return internalError(err)
+	}
+	m := &schema.Mutation{
+		ID:    schema.TimeUUID(),
+		Token: t,
+		Name:  schema.EnableTOTPMutation,
+		Args:  []interface{}{sub, sealed, hashes, now.Unix(), step},
+	}
+	if err := s.commit(r.Context(), m); err != nil {
+		return err
+	}
+	err = json.NewEncoder(w).Encode(&struct {
+		Success       bool     `json:"success"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		Success:       true,
+		RecoveryCodes: codes,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// totpDisableHandler turns off two-factor authentication. A valid code or
+// recovery code is required.
+func (s *Server) totpDisableHandler(w http.ResponseWriter, r *http.Request, t schema.Token) *Error {
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return userError(err)
+	}
+	sub := s.subject(t)
+	if sub == "" {
+		return userError(fmt.Errorf("token has no %s claim", s.cfg.UserClaim))
+	}
+	if s.qs == nil {
+		return tempError()
+	}
+	release, e := s.admit(s.authGate, r)
+	if e != nil {
+		return e
+	}
+	state, err := s.qs.TOTP(sub)
+	release()
+	if err != nil {
+		return internalError(err)
+	}
+	if state == nil {
+		return userError(errors.New("two-factor authentication is not enabled"))
+	}
+	if err := s.verifyTOTP(r.Context(), state, t, req.Code, req.RecoveryCode); err != nil {
+		return err
+	}
+	m := &schema.Mutation{
+		ID:    schema.TimeUUID(),
+		Token: t,
+		Name:  schema.DisableTOTPMutation,
+		Args:  []interface{}{sub},
+	}
+	if err := s.commit(r.Context(), m); err != nil {
+		return err
+	}
+	err = json.NewEncoder(w).Encode(&struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"arla/schema"
+	"arla/totp"
 	"bytes"
 	"encoding/json"
 	"errors"
@@ -9,11 +10,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"sync"
+	"time"
 )
 
 var tests = make([]*TestCase, 0)
 
-func req(url string, data interface{}, token string) *http.Response {
+func req(url string, data interface{}, u *User) *http.Response {
 	body, err := json.Marshal(data)
 	if err != nil {
 		panic(err)
@@ -26,9 +29,13 @@ func req(url string, data interface{}, token string) *http.Response {
 	}
 	fmt.Println(" ----> Content-Type:", ApplicationJSON)
 	req.Header.Set("Content-Type", ApplicationJSON)
-	if token != "" {
-		fmt.Println(" ----> Authorization: bearer", token)
-		req.Header.Add("Authorization", "bearer "+token)
+	if u.Token != "" {
+		fmt.Println(" ----> Authorization: bearer", u.Token)
+		req.Header.Add("Authorization", "bearer "+u.Token)
+	}
+	if u.APIKey != "" {
+		fmt.Println(" ----> "+APIKeyHeader+":", u.APIKey)
+		req.Header.Add(APIKeyHeader, u.APIKey)
 	}
 	fmt.Println(" ----> ", string(body))
 	var c http.Client
@@ -53,10 +60,42 @@ type TestCase struct {
 	resMap     map[string]interface{}
 	resString  string
 	shouldFail bool
+	// advance is added to the test clock before the request is made
+	advance time.Duration
+}
+
+// testClock is the server's clock for two-factor codes. It only moves when
+// a test case asks it to so codes never straddle a time step.
+var testClock = &fakeClock{t: time.Now()}
+
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// Now returns the clock's time
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Advance moves the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// After makes the request once the test clock has advanced by d
+func (tc *TestCase) After(d time.Duration) *TestCase {
+	tc.advance = d
+	return tc
 }
 
 func (tc *TestCase) Test() (err error) {
-	tc.res = req(tc.URL, tc.Data, tc.User.Token)
+	testClock.Advance(tc.advance)
+	tc.res = req(tc.URL, tc.Data, tc.User)
 	resBody, err := ioutil.ReadAll(tc.res.Body)
 	if err != nil {
 		return err
@@ -101,6 +140,33 @@ func (tc *TestCase) ShouldReturn(jsonResponse string) *TestCase {
 	return tc
 }
 
+// ShouldReturnResult checks the result returned by an /exec
+func (tc *TestCase) ShouldReturnResult(jsonResult string) *TestCase {
+	tc.Checks = append(tc.Checks, func() error {
+		var expected interface{}
+		if err := json.Unmarshal([]byte(jsonResult), &expected); err != nil {
+			return fmt.Errorf("invalid json in test case- ie. the test itself is broken")
+		}
+		if !reflect.DeepEqual(tc.resMap["result"], expected) {
+			return fmt.Errorf("expected exec result to be: %s\nbut got: %s\n", jsonResult, tc.resString)
+		}
+		return nil
+	})
+	return tc
+}
+
+// ShouldReturnCount checks the response has an array of n items at key
+func (tc *TestCase) ShouldReturnCount(key string, n int) *TestCase {
+	tc.Checks = append(tc.Checks, func() error {
+		items, ok := tc.resMap[key].([]interface{})
+		if !ok || len(items) != n {
+			return fmt.Errorf("expected %d items in '%s' but got: %s", n, key, tc.resString)
+		}
+		return nil
+	})
+	return tc
+}
+
 func (tc *TestCase) ShouldBeJSON() *TestCase {
 	tc.Checks = append(tc.Checks, func() error {
 		ct := tc.res.Header.Get("Content-Type")
@@ -158,12 +224,120 @@ func (tc *TestCase) ShouldBeAuthenticated() *TestCase {
 	return tc
 }
 
+// ShouldReturnAPIKey checks the response has a key and stores the
+// key on the given user so that future requests are made using it.
+func (tc *TestCase) ShouldReturnAPIKey(u *User) *TestCase {
+	tc.Checks = append(tc.Checks, func() error {
+		key, ok := tc.resMap["key"].(string)
+		if !ok || key == "" {
+			return fmt.Errorf("expected response to have key 'key' but got %v", tc.resString)
+		}
+		id, ok := tc.resMap["id"].(string)
+		if !ok {
+			return fmt.Errorf("expected response to have key 'id' but got %v", tc.resString)
+		}
+		var err error
+		if u.KeyID, err = schema.ParseUUID(id); err != nil {
+			return err
+		}
+		u.APIKey = key
+		return nil
+	})
+	return tc
+}
+
+// ShouldReturnTOTPEnrollment checks the response has a secret and
+// enrollment token and stores them on the user
+func (tc *TestCase) ShouldReturnTOTPEnrollment() *TestCase {
+	tc.Checks = append(tc.Checks, func() error {
+		var ok bool
+		if tc.User.TOTPSecret, ok = tc.resMap["secret"].(string); !ok {
+			return fmt.Errorf("expected response to have key 'secret' but got %v", tc.resString)
+		}
+		if tc.User.EnrollmentToken, ok = tc.resMap["enrollment_token"].(string); !ok {
+			return fmt.Errorf("expected response to have key 'enrollment_token' but got %v", tc.resString)
+		}
+		return nil
+	})
+	return tc
+}
+
+// ShouldReturnChallenge checks the response is a two-factor challenge
+// rather than an access token and stores the challenge on the user
+func (tc *TestCase) ShouldReturnChallenge() *TestCase {
+	tc.Checks = append(tc.Checks, func() error {
+		if _, ok := tc.resMap["access_token"]; ok {
+			return fmt.Errorf("expected response to not have an access_token but got %v", tc.resString)
+		}
+		var ok bool
+		if tc.User.ChallengeToken, ok = tc.resMap["challenge_token"].(string); !ok {
+			return fmt.Errorf("expected response to have key 'challenge_token' but got %v", tc.resString)
+		}
+		return nil
+	})
+	return tc
+}
+
+// ShouldReturnRecoveryCodes checks the response has the two-factor
+// recovery codes and stores them on the user
+func (tc *TestCase) ShouldReturnRecoveryCodes() *TestCase {
+	tc.Checks = append(tc.Checks, func() error {
+		codes, ok := tc.resMap["recovery_codes"].([]interface{})
+		if !ok || len(codes) == 0 {
+			return fmt.Errorf("expected response to have key 'recovery_codes' but got %v", tc.resString)
+		}
+		tc.User.RecoveryCodes = nil
+		for _, c := range codes {
+			code, ok := c.(string)
+			if !ok {
+				return fmt.Errorf("expected recovery codes to be strings got %v", tc.resString)
+			}
+			tc.User.RecoveryCodes = append(tc.User.RecoveryCodes, code)
+		}
+		return nil
+	})
+	return tc
+}
+
+// recoveryCode marshals to one of the user's recovery codes
+type recoveryCode struct {
+	u *User
+	i int
+}
+
+func (c recoveryCode) MarshalJSON() ([]byte, error) {
+	if c.i >= len(c.u.RecoveryCodes) {
+		return nil, fmt.Errorf("user has no recovery code %d", c.i)
+	}
+	return json.Marshal(c.u.RecoveryCodes[c.i])
+}
+
+// totpCode marshals to the current two-factor code for the user
+type totpCode struct {
+	u *User
+}
+
+func (c totpCode) MarshalJSON() ([]byte, error) {
+	code, err := totp.Code(c.u.TOTPSecret, testClock.Now())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(code)
+}
+
 type User struct {
 	ID       schema.UUID `json:"id"`
 	Name     string      `json:"name,omitempty"`
 	Username string      `json:"username,omitempty"`
 	Password string      `json:"password,omitempty"`
 	Token    string      `json:"-,omitempty"`
+	APIKey   string      `json:"-"`
+	KeyID    schema.UUID `json:"-"`
+	// two-factor authentication state
+	TOTPSecret      string   `json:"-"`
+	EnrollmentToken string   `json:"-"`
+	ChallengeToken  string   `json:"-"`
+	RecoveryCodes   []string `json:"-"`
 }
 
 // Query starts a /query request
@@ -180,6 +354,20 @@ func (u *User) Query(q string, args ...interface{}) *TestCase {
 	return tc
 }
 
+// QueryID starts a /query request for a persisted query
+func (u *User) QueryID(id string, args ...interface{}) *TestCase {
+	tc := &TestCase{
+		URL:  "/query",
+		User: u,
+		Data: &schema.Query{
+			ID:   id,
+			Args: args,
+		},
+	}
+	tests = append(tests, tc)
+	return tc
+}
+
 // Exec starts a /exec request
 func (u *User) Exec(name string, args ...interface{}) *TestCase {
 	tc := &TestCase{
@@ -194,6 +382,42 @@ func (u *User) Exec(name string, args ...interface{}) *TestCase {
 	return tc
 }
 
+// ExecVersion starts a /exec request from a client using an older api version
+func (u *User) ExecVersion(version int, name string, args ...interface{}) *TestCase {
+	tc := u.Exec(name, args...)
+	tc.Data.(*schema.Mutation).Version = version
+	return tc
+}
+
+// DryRun starts a /exec request that is not committed
+func (u *User) DryRun(name string, args ...interface{}) *TestCase {
+	tc := u.Exec(name, args...)
+	tc.URL = "/exec?dryRun=true"
+	return tc
+}
+
+// ExecBatch starts a /exec request that applies mutations atomically
+func (u *User) ExecBatch(mutations ...*schema.Mutation) *TestCase {
+	tc := &TestCase{
+		URL:  "/exec",
+		User: u,
+		Data: mutations,
+	}
+	tests = append(tests, tc)
+	return tc
+}
+
+// Admin starts a request to one of the /admin endpoints
+func (u *User) Admin(url string, data interface{}) *TestCase {
+	tc := &TestCase{
+		URL:  url,
+		User: u,
+		Data: data,
+	}
+	tests = append(tests, tc)
+	return tc
+}
+
 // Register attempts to sign up a user
 func (u *User) Register() *TestCase {
 	tc := &TestCase{
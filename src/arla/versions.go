@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// APIVersionHeader is the request header a client uses to declare the
+// version of the API it was written against
+const APIVersionHeader = "X-API-Version"
+
+// versionUsage counts the mutations received for each api version so that
+// it is clear when old clients have gone and their transforms can be dropped
+type versionUsage struct {
+	mu     sync.Mutex
+	counts map[int]int64
+}
+
+func (u *versionUsage) add(version int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.counts == nil {
+		u.counts = make(map[int]int64)
+	}
+	u.counts[version]++
+}
+
+// Stats returns the number of mutations seen for each version
+func (u *versionUsage) Stats() map[string]int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	stats := make(map[string]int64, len(u.counts))
+	for v, n := range u.counts {
+		stats[strconv.Itoa(v)] = n
+	}
+	return stats
+}
+
+// apiVersion returns the api version a mutation was written for. This is
+// declared by the mutation's version field or the X-API-Version header and
+// is the current version of the app if neither is set. Mutations for older
+// versions are logged as they are and transformed by the app config's
+// transform function when they are executed.
+func (s *Server) apiVersion(r *http.Request, declared int) (int, *Error) {
+	current := 0
+	if s.info != nil {
+		current = s.info.Version
+	}
+	version := declared
+	if h := r.Header.Get(APIVersionHeader); h != "" {
+		v, err := strconv.Atoi(h)
+		if err != nil || v <= 0 {
+			return 0, userError(fmt.Errorf("invalid %s header %q", APIVersionHeader, h))
+		}
+		if version != 0 && version != v {
+			return 0, userError(fmt.Errorf("mutation version %d does not match %s %d", version, APIVersionHeader, v))
+		}
+		version = v
+	}
+	if version == 0 {
+		version = current
+	}
+	if version < 0 || (current > 0 && version > current) {
+		return 0, userError(fmt.Errorf("unknown api version %d", version))
+	}
+	if version < s.cfg.MinAPIVersion {
+		return 0, versionError(version, s.cfg.MinAPIVersion)
+	}
+	s.versions.add(version)
+	return version, nil
+}
@@ -6,6 +6,16 @@ export function registerMember( {id, name, username, password} ) {
 	`, id, name, username, password];
 }
 
+// grantSuperUser gives a member access to the admin api
+export function grantSuperUser(id) {
+	if( !this.session.admin ){
+		throw new UserError('only admins can grant superuser');
+	}
+	return [`
+		update member set is_su = true where id = $1
+	`, id];
+}
+
 export function destroyMember() {
 	return [`
 		delete from member where id = $1
@@ -26,6 +36,36 @@ export function updateEmailAddress(oldAddr, newAddr) {
 	`, newAddr, oldAddr, this.session.id];
 }
 
+// setName changes the caller's name and returns the updated row
+export function setName(name) {
+	return [`
+		update member set name = $1 where id = $2
+		returning name
+	`, name, this.session.id];
+}
+setName.returns = 'row';
+
+// echoRequest returns the id of the request the mutation was received in
+export function echoRequest() {
+	return [`select $1::text as "requestId"`, this.meta.requestId];
+}
+echoRequest.meta = true;
+echoRequest.returns = 'row';
+
+// pinnedTime checks that arla_now() is the time the mutation was received
+export function pinnedTime() {
+	return [`select arla_now() = $1::timestamptz as pinned`, this.meta.received];
+}
+pinnedTime.meta = true;
+pinnedTime.returns = 'row';
+
+// pinnedValues returns the pinned time and random seed of the mutation
+export function pinnedValues() {
+	return [`select arla_now() as now, $1::text as seed`, this.meta.seed];
+}
+pinnedValues.meta = true;
+pinnedValues.returns = 'row';
+
 export function addFriend(friend_id) {
 	this.query(`
 		insert into friend (member_1_id, member_2_id)
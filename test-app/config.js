@@ -16,7 +16,8 @@ arla.configure({
 		return [`
 			select
 				id,
-				true as someflag
+				true as someflag,
+				is_su as admin
 			from member
 			where username = $1
 			and password = crypt($2, password)
@@ -59,6 +60,35 @@ arla.configure({
 		}
 		return Object.assign(m, {version: targetVersion});
 	},
+	// rateLimits overrides the exec rate limit for individual actions.
+	// rate is the number of requests allowed per minute for each user.
+	rateLimits: {
+		exampleOp: {rate: 1, burst: 1},
+	},
+	// cache marks root query properties whose results can be cached and
+	// shared between requests until a mutation changes the tables they read.
+	// Use `true` when the result is the same for every user, or list the
+	// session claims the result depends on with `{session: ['id']}`
+	// (`{session: true}` depends on the whole session).
+	// A query is only cached if all of its root properties are listed.
+	cache: {
+		countries: true,
+		numbers: true,
+		me: {session: ['id']},
+		someflag: {session: ['someflag']},
+	},
+	// timeouts overrides the --query-timeout in milliseconds for queries
+	// that select a root property. Queries running longer are cancelled.
+	timeouts: {
+		slow: 100,
+	},
+	// queries are persisted queries that clients can run by id with
+	// {"id": "myUsername", "args": [...]} instead of sending the query text.
+	// More can be loaded from a directory of .aql files with
+	// --persisted-queries-dir and --persisted-queries-only rejects all others.
+	queries: {
+		myUsername: `me(){username}`,
+	},
 	// bootstrap is an optional array of SQL statements to execute before any
 	// mutations are replayed.
 	// This allows you to setup the database, install extensions and setup any
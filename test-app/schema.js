@@ -41,6 +41,11 @@ export default class root extends arla.Entity {
 		// someflag should be set from the authentication function in arla.configure
 		someflag: {type: Boolean, query: function(){
 			return [`select $1`, this.session.someflag];
+		}},
+
+		// slow takes longer than its timeout set in arla.configure
+		slow: {type: Boolean, query: function(){
+			return `select true from pg_sleep(10)`;
 		}}
 	}
 